@@ -0,0 +1,420 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/paypal/katbox/pkg/katbox"
+)
+
+const usage = `Usage: katboxctl [flags] <command> [arguments]
+
+Commands:
+  status                  Show a summary of the node
+  volumes [volume ID]     List live volumes or show a single one
+  candidates [volume ID]  List volumes queued for deletion or show a single one
+  pod <pod UUID>          List the volumes of a pod queued for deletion
+  prune                   Run a prune round right away
+  delete [-pod] <ID>      Delete a queued volume right away, even if it is pinned or stuck, or every queued
+                          volume of a pod with -pod
+  retain [-pod] <ID> -for <duration>
+                          Keep a queued volume, or every queued volume of a pod with -pod, for at least the
+                          duration from now
+  pin [-pod] <ID> -owner <owner> -reason <reason> [-expiry <RFC 3339 time>]
+                          Pin a queued volume, or every queued volume of a pod with -pod
+  unpin [-pod] <ID>       Unpin a queued volume, or every queued volume of a pod with -pod
+  mount <volume ID> <path>
+                          Mount a queued image volume read only at a path of the node for inspection
+  unmount <volume ID>     Unmount a queued image volume mounted for inspection
+
+Flags:
+`
+
+var (
+	endpoint = flag.String("endpoint", "unix://tmp/katbox-admin.sock", "Unix socket on which the katbox admin API is served")
+	output   = flag.String("o", "table", "Output format: table or json")
+	timeout  = flag.Duration("timeout", 5*time.Minute, "Maximum amount of time to wait for a response")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q, must be table or json\n", *output)
+		os.Exit(2)
+	}
+
+	c := newClient(*endpoint, *timeout)
+	if err := run(c, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(c *client, command string, args []string) error {
+	switch command {
+	case "status":
+		var status katbox.Status
+		return c.do(http.MethodGet, "/v1/status", nil, &status, func(w io.Writer) {
+			fmt.Fprintf(w, "NODE\t%s\n", status.NodeID)
+			fmt.Fprintf(w, "VOLUMES\t%d\n", status.Volumes)
+			fmt.Fprintf(w, "CANDIDATES\t%d\n", status.Candidates)
+			fmt.Fprintf(w, "STUCK\t%d\n", status.Stuck)
+			fmt.Fprintf(w, "PRESSURE FACTOR\t%.2f\n", status.PressureFactor)
+			fmt.Fprintf(w, "LAST PRUNE ROUND\t%s\n", formatTime(status.LastPruneRound))
+			for _, pool := range status.Pools {
+				fmt.Fprintf(w, "POOL %s\theadroom %.2f, pressure factor %.2f, reclaimed %s of %s needed, %s\n",
+					pool.Name, pool.Headroom, pool.PressureFactor,
+					formatSize(pool.ReclaimedBytes), formatSize(pool.TargetBytes), pool.Workdir)
+				if pool.InodeHeadroom > 0 {
+					fmt.Fprintf(w, "POOL %s INODES\theadroom %.2f, reclaimed %d of %d needed\n",
+						pool.Name, pool.InodeHeadroom, pool.ReclaimedInodes, pool.TargetInodes)
+				}
+			}
+		})
+	case "volumes":
+		if len(args) > 1 {
+			return errors.New("volumes takes at most one volume ID")
+		}
+
+		var volumes []katbox.Volume
+		if len(args) == 1 {
+			volumes = make([]katbox.Volume, 1)
+			return c.do(http.MethodGet, "/v1/volumes/"+args[0], nil, &volumes[0], printVolumes(&volumes))
+		}
+		return c.do(http.MethodGet, "/v1/volumes", nil, &volumes, printVolumes(&volumes))
+	case "candidates":
+		if len(args) > 1 {
+			return errors.New("candidates takes at most one volume ID")
+		}
+
+		var candidates []katbox.Candidate
+		if len(args) == 1 {
+			candidates = make([]katbox.Candidate, 1)
+			return c.do(http.MethodGet, "/v1/candidates/"+args[0], nil, &candidates[0], printCandidates(&candidates))
+		}
+		return c.do(http.MethodGet, "/v1/candidates", nil, &candidates, printCandidates(&candidates))
+	case "pod":
+		if len(args) != 1 {
+			return errors.New("pod takes exactly one pod UUID")
+		}
+
+		var candidates []katbox.Candidate
+		return c.do(http.MethodGet, "/v1/pods/"+args[0], nil, &candidates, printCandidates(&candidates))
+	case "prune":
+		var resp katbox.DeleteResponse
+		return c.do(http.MethodPost, "/v1/prune", nil, &resp, printDeleted(&resp))
+	case "delete":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		pod := flags.Bool("pod", false, "Treat the ID as a pod UUID and delete every queued volume of the pod")
+		id, err := parseID(flags, command, args)
+		if err != nil {
+			return err
+		}
+
+		path := "/v1/candidates/" + id
+		if *pod {
+			path = "/v1/pods/" + id
+		}
+		var resp katbox.DeleteResponse
+		return c.do(http.MethodDelete, path, nil, &resp, printDeleted(&resp))
+	case "retain":
+		return retain(c, args)
+	case "pin", "unpin":
+		return pin(c, command, args)
+	case "mount":
+		if len(args) != 2 {
+			return errors.New("mount takes exactly one volume ID and one path")
+		}
+
+		var candidate katbox.Candidate
+		req := katbox.MountRequest{Path: args[1]}
+		return c.do(http.MethodPost, "/v1/candidates/"+args[0]+"/mount", req, &candidate, printInspected(&candidate))
+	case "unmount":
+		if len(args) != 1 {
+			return errors.New("unmount takes exactly one volume ID")
+		}
+
+		var candidate katbox.Candidate
+		return c.do(http.MethodDelete, "/v1/candidates/"+args[0]+"/mount", nil, &candidate, printInspected(&candidate))
+	default:
+		return fmt.Errorf("unknown command %q, run katboxctl -h for usage", command)
+	}
+}
+
+func pin(c *client, command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	pod := flags.Bool("pod", false, "Treat the ID as a pod UUID and apply to every queued volume of the pod")
+	var req katbox.PinRequest
+	if command == "pin" {
+		flags.StringVar(&req.Owner, "owner", "", "Who is pinning the volumes")
+		flags.StringVar(&req.Reason, "reason", "", "Why the volumes are pinned")
+		flags.StringVar(&req.Expiry, "expiry", "", "RFC 3339 time after which the pin no longer applies")
+	}
+
+	id, err := parseID(flags, command, args)
+	if err != nil {
+		return err
+	}
+
+	path := "/v1/candidates/" + id + "/pin"
+	if *pod {
+		path = "/v1/pods/" + id + "/pin"
+	}
+
+	method, body := http.MethodPost, interface{}(req)
+	if command == "unpin" {
+		method, body = http.MethodDelete, nil
+	}
+
+	var resp katbox.PinResponse
+	return c.do(method, path, body, &resp, func(w io.Writer) {
+		fmt.Fprintln(w, "VOLUME")
+		for _, id := range resp.VolumeIDs {
+			fmt.Fprintln(w, id)
+		}
+	})
+}
+
+func retain(c *client, args []string) error {
+	flags := flag.NewFlagSet("retain", flag.ExitOnError)
+	pod := flags.Bool("pod", false, "Treat the ID as a pod UUID and apply to every queued volume of the pod")
+	var req katbox.RetainRequest
+	flags.StringVar(&req.Retention, "for", "", "How long from now the volumes are kept at least, e.g. 24h")
+
+	id, err := parseID(flags, "retain", args)
+	if err != nil {
+		return err
+	}
+
+	path := "/v1/candidates/" + id + "/retain"
+	if *pod {
+		path = "/v1/pods/" + id + "/retain"
+	}
+
+	var candidates []katbox.Candidate
+	return c.do(http.MethodPost, path, req, &candidates, printCandidates(&candidates))
+}
+
+// parseID parses the flags of a command taking a single ID, allowing flags to come after the ID.
+func parseID(flags *flag.FlagSet, command string, args []string) (string, error) {
+	var id string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return "", err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		if id != "" {
+			return "", fmt.Errorf("%s takes exactly one ID", command)
+		}
+		id, args = flags.Arg(0), flags.Args()[1:]
+	}
+	if id == "" {
+		return "", fmt.Errorf("%s takes exactly one ID", command)
+	}
+	return id, nil
+}
+
+func printVolumes(volumes *[]katbox.Volume) func(io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "VOLUME\tPOD\tPOOL\tTYPE\tSIZE\tINODES\tRETENTION\tPATH")
+		for _, vol := range *volumes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				vol.ID, vol.PodUUID, vol.Pool, vol.AccessType, formatSize(vol.Size),
+				formatCount(vol.Inodes), formatDuration(vol.Retention), vol.Path)
+		}
+	}
+}
+
+func printCandidates(candidates *[]katbox.Candidate) func(io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "VOLUME\tPOD\tPOOL\tSIZE\tDELETED\tLIFESPAN\tEVICTION\tFAILURES\tSTATE\tPATH")
+		for _, vol := range *candidates {
+			state := "queued"
+			switch {
+			case vol.Stuck:
+				state = "stuck"
+			case vol.InspectPath != "":
+				state = "mounted at " + vol.InspectPath
+			case len(vol.Viewers) > 0:
+				state = "attached to " + strings.Join(vol.Viewers, ",")
+			case vol.PinOwner != "" && (vol.PinExpiry == nil || vol.PinExpiry.After(time.Now())):
+				state = "pinned by " + vol.PinOwner
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				vol.ID, vol.PodUUID, vol.Pool, formatSize(vol.SizeBytes), formatTime(vol.DeleteTime), vol.Lifespan,
+				formatTime(vol.EvictionTime), vol.Failures, state, vol.Path)
+		}
+	}
+}
+
+func printInspected(candidate *katbox.Candidate) func(io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "VOLUME\tMOUNTED AT")
+		mountedAt := candidate.InspectPath
+		if mountedAt == "" {
+			mountedAt = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", candidate.ID, mountedAt)
+	}
+}
+
+func printDeleted(resp *katbox.DeleteResponse) func(io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "VOLUME")
+		for _, id := range resp.VolumeIDs {
+			fmt.Fprintln(w, id)
+		}
+		fmt.Fprintf(w, "\nReclaimed %s\n", formatSize(resp.ReclaimedBytes))
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func formatDuration(d *time.Duration) string {
+	if d == nil {
+		return "-"
+	}
+	return d.String()
+}
+
+func formatCount(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// client talks to the admin API over its unix socket.
+type client struct {
+	http *http.Client
+}
+
+func newClient(endpoint string, timeout time.Duration) *client {
+	addr := strings.TrimPrefix(endpoint, "unix://")
+	if !strings.HasPrefix(addr, "/") {
+		addr = "/" + addr
+	}
+
+	return &client{http: &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		},
+	}}
+}
+
+// do sends the request and prints the response, either as JSON or by decoding it into resp and calling table.
+func (c *client) do(method, path string, body, resp interface{}, table func(io.Writer)) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	// The host is ignored since requests are sent over the unix socket
+	req, err := http.NewRequest(method, "http://katbox"+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach katbox: %w", err)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var errResp katbox.ErrorResponse
+		if err := json.Unmarshal(data, &errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("katbox returned %s", res.Status)
+		}
+		return errors.New(errResp.Error)
+	}
+
+	if *output == "json" {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, data, "", "  "); err != nil {
+			return err
+		}
+		_, err := indented.WriteTo(os.Stdout)
+		return err
+	}
+
+	if err := json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("unable to decode response: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
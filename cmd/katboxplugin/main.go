@@ -18,41 +18,192 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
-	"time"
+	"syscall"
 
+	"github.com/golang/glog"
 	"github.com/paypal/katbox/pkg/katbox"
 )
 
 func init() {
 	flag.Set("logtostderr", "true")
+	registerFlags(flag.CommandLine, &flagOptions)
 }
 
 var (
-	endpoint          = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	driverName        = flag.String("drivername", "katbox.csi.paypal.com", "name of the driver")
-	nodeID            = flag.String("nodeid", "", "node id")
-	maxVolumesPerNode = flag.Int64("maxvolumespernode", 0, "limit of volumes per node")
-	workdir           = flag.String("workdir", "/csi-data-dir", "Location where plugin will store configuration and directories")
-	afterLifespan     = flag.Duration(
+	// flagOptions holds the options set through flags, which take precedence over the configuration file
+	flagOptions = katbox.DefaultOptions()
+
+	configFile = flag.String(
+		"config",
+		"",
+		"Path to a YAML or JSON configuration file. Flags given on the command line override its settings. "+
+			"The prune interval and headrooms are reloaded from it on SIGHUP.",
+	)
+	showVersion = flag.Bool("version", false, "Show version.")
+	// Set by the build process
+	version = ""
+)
+
+// registerFlags binds a flag to every option, using the current value of the option as the flag's default.
+func registerFlags(fs *flag.FlagSet, o *katbox.Options) {
+	fs.StringVar(&o.Endpoint, "endpoint", o.Endpoint, "CSI endpoint")
+	fs.StringVar(&o.DriverName, "drivername", o.DriverName, "name of the driver")
+	fs.StringVar(&o.NodeID, "nodeid", o.NodeID, "node id")
+	fs.Int64Var(&o.MaxVolumesPerNode, "maxvolumespernode", o.MaxVolumesPerNode, "limit of volumes per node")
+	fs.StringVar(&o.Workdir, "workdir", o.Workdir, "Location where plugin will store configuration and directories")
+	fs.StringVar(
+		&o.TemplatesDir,
+		"templates-dir",
+		o.TemplatesDir,
+		"Directory holding the templates, directories or tar archives, new volumes may be seeded from. Templates are disabled when empty.",
+	)
+	fs.StringVar(
+		&o.VolumeMode,
+		"volume-mode",
+		o.VolumeMode,
+		"Octal permissions of volume directories which don't set the mode attribute.",
+	)
+	fs.DurationVar(
+		&o.AfterlifeSpan,
 		"afterlifespan",
-		time.Hour*12,
+		o.AfterlifeSpan,
 		"Length of time to keep a volume after a request for deletion",
 	)
-	pruneInterval = flag.Duration(
+	fs.DurationVar(
+		&o.MinAfterlifeSpan,
+		"min-afterlifespan",
+		o.MinAfterlifeSpan,
+		"Shortest retention a pod may request for its volumes through the retention volume attribute",
+	)
+	fs.DurationVar(
+		&o.MaxAfterlifeSpan,
+		"max-afterlifespan",
+		o.MaxAfterlifeSpan,
+		"Longest retention a pod may request for its volumes through the retention volume attribute. Zero means unbounded.",
+	)
+	fs.DurationVar(
+		&o.PruneInterval,
 		"pruneinterval",
-		time.Second*5,
+		o.PruneInterval,
 		"Interval at which the background process looking to evict deleted volumes runs.",
 	)
-	headroom = flag.Float64(
+	fs.DurationVar(
+		&o.DeleteTimeout,
+		"deletetimeout",
+		o.DeleteTimeout,
+		"Maximum amount of time the pruner waits for a single volume to be deleted before moving on.",
+	)
+	fs.IntVar(
+		&o.MaxDeleteAttempts,
+		"maxdeleteattempts",
+		o.MaxDeleteAttempts,
+		"Number of failed attempts after which a volume is considered stuck and no longer retried by the pruner.",
+	)
+	fs.IntVar(
+		&o.PruneStallMultiple,
+		"prunestallmultiple",
+		o.PruneStallMultiple,
+		"Number of prune intervals the pruner may go without finishing a round before the plugin reports itself as not ready. Zero disables the check.",
+	)
+	fs.DurationVar(
+		&o.SoftLimitInterval,
+		"softlimitinterval",
+		o.SoftLimitInterval,
+		"Interval at which volume sizes are checked when the filesystem does not support project quotas.",
+	)
+	fs.DurationVar(
+		&o.ReconcileInterval,
+		"reconcileinterval",
+		o.ReconcileInterval,
+		"Interval at which volume records are checked against the working directory and mounts. They are always checked at startup, zero disables periodic checks.",
+	)
+	fs.Float64Var(
+		&o.Headroom,
 		"headroom",
-		0.1,
+		o.Headroom,
 		"Value between 0.0 and 1.0 (inclusive) that determines the percentage of space that should be attempted to be kept free in the underlying storage device",
 	)
-	showVersion = flag.Bool("version", false, "Show version.")
-	// Set by the build process
-	version = ""
-)
+	fs.Float64Var(
+		&o.InodeHeadroom,
+		"inode-headroom",
+		o.InodeHeadroom,
+		"Value between 0.0 and 1.0 (inclusive) that determines the percentage of inodes that should be attempted to be kept free in the underlying storage device, zero disables inode pressure",
+	)
+	fs.StringVar(
+		&o.EvictionPolicy,
+		"eviction-policy",
+		o.EvictionPolicy,
+		"Policy used to pick which retained volumes are deleted: time, largest-first, oldest-first or lru",
+	)
+	fs.StringVar(
+		&o.PressureCurve,
+		"pressure-curve",
+		o.PressureCurve,
+		"Curve turning the utilization of the underlying storage device into the pressure factor: linear, exponential or steps such as \"85%=0.5, 95%=0.1\"",
+	)
+	fs.Float64Var(
+		&o.PressureFloor,
+		"pressure-floor",
+		o.PressureFloor,
+		"Lowest pressure factor applied unless the underlying storage device is critically full",
+	)
+	fs.Float64Var(
+		&o.CriticalHeadroom,
+		"critical-headroom",
+		o.CriticalHeadroom,
+		"Value between 0.0 and 1.0 (inclusive), the share of space or inodes left free below which the pressure floor no longer applies",
+	)
+	fs.StringVar(
+		&o.MetricsAddress,
+		"metrics-address",
+		o.MetricsAddress,
+		"Address on which Prometheus metrics are served, e.g. :9809. Metrics are disabled when empty.",
+	)
+	fs.StringVar(
+		&o.AdminEndpoint,
+		"admin-endpoint",
+		o.AdminEndpoint,
+		"Unix socket on which the local admin API used by katboxctl is served. The admin API is disabled when empty.",
+	)
+	fs.BoolVar(
+		&o.WatchPods,
+		"watch-pods",
+		o.WatchPods,
+		"Watch the pods of this node through the Kubernetes API and queue the volumes of deleted pods which were never unpublished.",
+	)
+	fs.StringVar(
+		&o.Kubeconfig,
+		"kubeconfig",
+		o.Kubeconfig,
+		"Path to the kubeconfig used to reach the Kubernetes API. The pod's service account is used when empty.",
+	)
+	fs.DurationVar(
+		&o.PodSweepInterval,
+		"pod-sweep-interval",
+		o.PodSweepInterval,
+		"Interval at which volumes are checked against the pods known to the Kubernetes API when --watch-pods is set.",
+	)
+	fs.BoolVar(
+		&o.EmitEvents,
+		"emit-events",
+		o.EmitEvents,
+		"Record Kubernetes events on pods, or on the node once a pod is gone, as their volumes are published, queued and deleted.",
+	)
+	fs.Float64Var(
+		&o.EventQPS,
+		"event-qps",
+		o.EventQPS,
+		"Events per second which may be recorded about a single pod or node once --event-burst is exhausted.",
+	)
+	fs.IntVar(
+		&o.EventBurst,
+		"event-burst",
+		o.EventBurst,
+		"Number of events which may be recorded about a single pod or node before --event-qps applies.",
+	)
+}
 
 func main() {
 	flag.Parse()
@@ -67,21 +218,57 @@ func main() {
 	os.Exit(0)
 }
 
+// loadOptions returns the default options overridden by the configuration file, if any,
+// and then by the flags given on the command line.
+func loadOptions() (katbox.Options, error) {
+	opts := katbox.DefaultOptions()
+	if *configFile != "" {
+		if err := katbox.LoadConfig(*configFile, &opts); err != nil {
+			return opts, err
+		}
+	}
+
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	registerFlags(overrides, &opts)
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil && overrides.Lookup(f.Name) != nil {
+			err = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	opts.Version = version
+	return opts, err
+}
+
 func handle() {
-	driver, err := katbox.NewKatboxDriver(
-		*driverName,
-		*nodeID,
-		*endpoint,
-		*workdir,
-		*maxVolumesPerNode,
-		*afterLifespan,
-		*pruneInterval,
-		*headroom,
-		version,
-	)
+	opts, err := loadOptions()
+	if err != nil {
+		fmt.Printf("Failed to load configuration: %s", err.Error())
+		os.Exit(1)
+	}
+
+	driver, err := katbox.NewKatboxDriver(opts)
 	if err != nil {
 		fmt.Printf("Failed to initialize driver: %s", err.Error())
 		os.Exit(1)
 	}
+
+	// Reload the settings which are safe to change at runtime on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			glog.Info("received SIGHUP, reloading configuration")
+			opts, err := loadOptions()
+			if err == nil {
+				err = driver.Reload(opts)
+			}
+			if err != nil {
+				glog.Errorf("unable to reload configuration, keeping the current one: %s", err)
+			}
+		}
+	}()
+
 	driver.Run()
 }
@@ -0,0 +1,624 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/mount-utils"
+)
+
+// PinRequest is the body accepted when pinning retained volumes through the admin API.
+type PinRequest struct {
+	Owner  string `json:"owner"`
+	Reason string `json:"reason"`
+
+	// Expiry is an optional RFC 3339 timestamp after which the pin no longer applies.
+	Expiry string `json:"expiry,omitempty"`
+}
+
+// MountRequest is the body accepted when mounting a retained image volume for inspection through the admin API.
+type MountRequest struct {
+	// Path is the directory on the node the volume is mounted at, read only.
+	Path string `json:"path"`
+}
+
+// RetainRequest is the body accepted when extending the afterlife of retained volumes through the admin API.
+type RetainRequest struct {
+	// Retention is how long from now the volumes are kept at least, e.g. 24h.
+	Retention string `json:"retention"`
+}
+
+// PinResponse lists the volumes affected by a pin or unpin request.
+type PinResponse struct {
+	VolumeIDs []string `json:"volumeIDs"`
+}
+
+// Volume describes a live volume in admin API responses.
+type Volume struct {
+	ID         string         `json:"id"`
+	Name       string         `json:"name"`
+	PodUUID    string         `json:"podUUID"`
+	Pool       string         `json:"pool"`
+	Path       string         `json:"path"`
+	AccessType string         `json:"accessType"`
+	Size       int64          `json:"size"`
+	Inodes     int64          `json:"inodes,omitempty"`
+	Retention  *time.Duration `json:"retention,omitempty"`
+	OverLimit  bool           `json:"overLimit,omitempty"`
+
+	// Retained is the ID of the retained volume shown read only by this volume, if any.
+	Retained string `json:"retained,omitempty"`
+}
+
+// Candidate describes a volume queued for deletion in admin API responses.
+type Candidate struct {
+	ID         string        `json:"id"`
+	PodUUID    string        `json:"podUUID"`
+	Pool       string        `json:"pool"`
+	Path       string        `json:"path"`
+	AccessType string        `json:"accessType"`
+	DeleteTime time.Time     `json:"deleteTime"`
+	Lifespan   time.Duration `json:"lifespan"`
+
+	// SizeBytes and Inodes are the space and inodes the candidate used on disk when it was last measured.
+	SizeBytes int64 `json:"sizeBytes"`
+	Inodes    int64 `json:"inodes"`
+
+	// EvictionTime is the point in time after which the pruner evicts the candidate
+	// if the pressure factor stays as it was during the last prune round.
+	EvictionTime time.Time `json:"evictionTime"`
+
+	Failures int  `json:"failures,omitempty"`
+	Stuck    bool `json:"stuck,omitempty"`
+
+	PinOwner  string     `json:"pinOwner,omitempty"`
+	PinReason string     `json:"pinReason,omitempty"`
+	PinExpiry *time.Time `json:"pinExpiry,omitempty"`
+
+	// InspectPath is where the volume is mounted for inspection, if it is.
+	InspectPath string `json:"inspectPath,omitempty"`
+
+	// Viewers are the volumes showing the candidate read only to other pods.
+	Viewers []string `json:"viewers,omitempty"`
+}
+
+// Status summarizes the state of the node.
+type Status struct {
+	NodeID         string    `json:"nodeID"`
+	Volumes        int       `json:"volumes"`
+	Candidates     int       `json:"candidates"`
+	Stuck          int       `json:"stuck"`
+	PressureFactor float64   `json:"pressureFactor"`
+	LastPruneRound time.Time `json:"lastPruneRound"`
+
+	// Pools holds the state of every storage pool, PressureFactor being the one of the default pool.
+	Pools []PoolStatus `json:"pools"`
+}
+
+// PoolStatus summarizes the state of a storage pool.
+type PoolStatus struct {
+	Name           string  `json:"name"`
+	Workdir        string  `json:"workdir"`
+	Headroom       float64 `json:"headroom"`
+	PressureFactor float64 `json:"pressureFactor"`
+
+	// TargetBytes is how much the last prune round had to free to get the pool back above its headroom
+	// and ReclaimedBytes how much it actually freed.
+	TargetBytes    int64 `json:"targetBytes"`
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+
+	// InodeHeadroom, TargetInodes and ReclaimedInodes are their counterparts for inodes.
+	InodeHeadroom   float64 `json:"inodeHeadroom"`
+	TargetInodes    int64   `json:"targetInodes"`
+	ReclaimedInodes int64   `json:"reclaimedInodes"`
+}
+
+// DeleteResponse lists the volumes deleted by a forced prune or deletion along with the space they freed.
+type DeleteResponse struct {
+	VolumeIDs      []string `json:"volumeIDs"`
+	ReclaimedBytes int64    `json:"reclaimedBytes"`
+}
+
+// ErrorResponse is returned by the admin API whenever a request fails.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// adminServer serves node local administrative operations over a unix socket,
+// separate from the CSI socket shared with the kubelet.
+type adminServer struct {
+	node    *node
+	mounter mount.Interface
+}
+
+func newAdminServer(n *node, mounter mount.Interface) *adminServer {
+	return &adminServer{node: n, mounter: mounter}
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", a.handleStatus)
+	mux.HandleFunc("/v1/prune", a.handlePrune)
+	mux.HandleFunc("/v1/volumes", a.handleVolumes)
+	mux.HandleFunc("/v1/volumes/", a.handleVolume)
+	mux.HandleFunc("/v1/candidates", a.handleCandidates)
+	mux.HandleFunc("/v1/candidates/", a.handleCandidate)
+	mux.HandleFunc("/v1/pods/", a.handlePod)
+	return mux
+}
+
+// serve listens on the unix socket described by endpoint. It blocks until the server stops.
+func (a *adminServer) serve(endpoint string) {
+	proto, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		glog.Errorf("unable to start admin server: %s", err)
+		return
+	}
+
+	if proto != "unix" {
+		glog.Errorf("admin server only listens on unix sockets, got %s", endpoint)
+		return
+	}
+
+	addr = "/" + addr
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("failed to remove %s: %s", addr, err)
+		return
+	}
+
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		glog.Errorf("admin server failed to listen: %s", err)
+		return
+	}
+
+	// Only the user running the plugin may administer it
+	if err := os.Chmod(addr, 0600); err != nil {
+		glog.Errorf("unable to restrict access to %s: %s", addr, err)
+		listener.Close()
+		return
+	}
+
+	glog.Infof("Serving admin API on address: %s", addr)
+	if err := http.Serve(listener, a.handler()); err != nil {
+		glog.Errorf("admin server stopped: %s", err)
+	}
+}
+
+// handleStatus serves /v1/status
+func (a *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	d := &a.node.deletedVolumes
+	d.lock.RLock()
+	candidates := len(d.candidates)
+	d.lock.RUnlock()
+
+	_, headroom := d.settings.get()
+	pools := []PoolStatus{}
+	for _, p := range a.node.listPools() {
+		poolHeadroom := headroom
+		if p.headroom != nil {
+			poolHeadroom = *p.headroom
+		}
+		reclaim := d.lastPoolReclaim(p.name)
+		pools = append(pools, PoolStatus{
+			Name:           p.name,
+			Workdir:        p.workdir,
+			Headroom:       poolHeadroom,
+			PressureFactor: d.lastPressureFactor(p.name),
+			TargetBytes:    reclaim.target,
+			ReclaimedBytes: reclaim.reclaimed,
+
+			InodeHeadroom:   d.settings.getInodeHeadroom(),
+			TargetInodes:    reclaim.inodeTarget,
+			ReclaimedInodes: reclaim.reclaimedInodes,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, Status{
+		NodeID:         a.node.id,
+		Volumes:        len(a.node.listVolumes()),
+		Candidates:     candidates,
+		Stuck:          d.stuckCount(),
+		PressureFactor: d.lastPressureFactor(defaultPoolName),
+		LastPruneRound: d.lastRoundTime(),
+		Pools:          pools,
+	})
+}
+
+// handlePrune serves /v1/prune by running a prune round right away.
+func (a *adminServer) handlePrune(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	glog.Info("prune round forced through the admin API")
+	_, headroom := a.node.deletedVolumes.settings.get()
+	deleted, reclaimed := a.node.deletedVolumes.prune(a.node.workdir, headroom)
+	if deleted == nil {
+		deleted = []string{}
+	}
+	writeJSON(w, http.StatusOK, DeleteResponse{VolumeIDs: deleted, ReclaimedBytes: reclaimed})
+}
+
+// handleVolumes serves /v1/volumes
+func (a *adminServer) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	volumes := []Volume{}
+	for _, vol := range a.node.listVolumes() {
+		volumes = append(volumes, toVolume(vol))
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID < volumes[j].ID
+	})
+	writeJSON(w, http.StatusOK, volumes)
+}
+
+// handleVolume serves /v1/volumes/<volume ID>
+func (a *adminServer) handleVolume(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/volumes/")
+	vol, err := a.node.volumeByID(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("volume %s is not published on this node", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, toVolume(vol))
+}
+
+// handleCandidates serves /v1/candidates
+func (a *adminServer) handleCandidates(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	d := &a.node.deletedVolumes
+	candidates := []Candidate{}
+	d.lock.RLock()
+	for id, vol := range d.candidates {
+		if vol != nil {
+			candidates = append(candidates, toCandidate(id, vol, d.lastPressureFactor(vol.Pool)))
+		}
+	}
+	d.lock.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return byTime(candidates[i].ID, candidates[j].ID, candidates[i].EvictionTime, candidates[j].EvictionTime)
+	})
+	writeJSON(w, http.StatusOK, candidates)
+}
+
+// handleCandidate serves /v1/candidates/<volume ID>, /v1/candidates/<volume ID>/pin, /v1/candidates/<volume ID>/retain
+// and /v1/candidates/<volume ID>/mount
+func (a *adminServer) handleCandidate(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/candidates/"), "/")
+	if parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		a.candidate(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "pin":
+		a.pin(w, r, []string{parts[0]})
+	case len(parts) == 2 && parts[1] == "retain":
+		a.retain(w, r, []string{parts[0]})
+	case len(parts) == 2 && parts[1] == "mount":
+		a.mount(w, r, parts[0])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+	}
+}
+
+// handlePod serves /v1/pods/<pod UUID>, /v1/pods/<pod UUID>/pin and /v1/pods/<pod UUID>/retain
+func (a *adminServer) handlePod(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/pods/"), "/")
+	if parts[0] == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "pin" && parts[1] != "retain") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+
+	ids := a.node.deletedVolumes.idsForPod(parts[0])
+	if len(ids) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("pod %s has no volumes queued for deletion", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		a.pod(w, r, parts[0], ids)
+	case parts[1] == "pin":
+		a.pin(w, r, ids)
+	default:
+		a.retain(w, r, ids)
+	}
+}
+
+// pod returns the candidates of the pod on GET and deletes all of them from disk right away on DELETE.
+func (a *adminServer) pod(w http.ResponseWriter, r *http.Request, podUUID string, ids []string) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	d := &a.node.deletedVolumes
+	if r.Method == http.MethodDelete {
+		deleted, reclaimed, err := d.forceDeletePod(podUUID)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, errCandidateNotFound) {
+				code = http.StatusNotFound
+			} else if errors.Is(err, errCandidateMounted) {
+				code = http.StatusConflict
+			}
+			writeError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, DeleteResponse{VolumeIDs: deleted, ReclaimedBytes: reclaimed})
+		return
+	}
+
+	candidates := make([]Candidate, 0, len(ids))
+	for _, id := range ids {
+		if vol, found := d.get(id); found {
+			candidates = append(candidates, toCandidate(id, vol, d.lastPressureFactor(vol.Pool)))
+		}
+	}
+	writeJSON(w, http.StatusOK, candidates)
+}
+
+// retain extends the afterlife of the volumes on POST.
+func (a *adminServer) retain(w http.ResponseWriter, r *http.Request, ids []string) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req RetainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid retain request: %w", err))
+		return
+	}
+	retention, err := time.ParseDuration(req.Retention)
+	if err != nil || retention <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid retention %q: must be a positive duration", req.Retention))
+		return
+	}
+
+	d := &a.node.deletedVolumes
+	retained, err := d.retain(ids, retention)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errCandidateNotFound) {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err)
+		return
+	}
+
+	candidates := make([]Candidate, 0, len(retained))
+	for i, vol := range retained {
+		candidates = append(candidates, toCandidate(ids[i], vol, d.lastPressureFactor(vol.Pool)))
+	}
+	writeJSON(w, http.StatusOK, candidates)
+}
+
+// candidate returns the candidate on GET and deletes it from disk right away on DELETE.
+func (a *adminServer) candidate(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	d := &a.node.deletedVolumes
+	if r.Method == http.MethodDelete {
+		reclaimed, err := d.forceDelete(id)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, errCandidateNotFound) {
+				code = http.StatusNotFound
+			} else if errors.Is(err, errCandidateMounted) {
+				code = http.StatusConflict
+			}
+			writeError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, DeleteResponse{VolumeIDs: []string{id}, ReclaimedBytes: reclaimed})
+		return
+	}
+
+	vol, found := d.get(id)
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %w", id, errCandidateNotFound))
+		return
+	}
+	writeJSON(w, http.StatusOK, toCandidate(id, vol, d.lastPressureFactor(vol.Pool)))
+}
+
+// pin pins the volumes on POST and unpins them on DELETE.
+func (a *adminServer) pin(w http.ResponseWriter, r *http.Request, ids []string) {
+	var p *pin
+
+	switch r.Method {
+	case http.MethodPost:
+		var req PinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid pin request: %w", err))
+			return
+		}
+
+		var err error
+		p, err = req.toPin()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if err := a.node.deletedVolumes.setPin(ids, p); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errCandidateNotFound) {
+			code = http.StatusNotFound
+		}
+		writeError(w, code, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PinResponse{VolumeIDs: ids})
+}
+
+// mount mounts a retained image volume read only for inspection on POST and unmounts it on DELETE.
+func (a *adminServer) mount(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	var vol *deletionCandidate
+	var err error
+	if r.Method == http.MethodPost {
+		var req MountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid mount request: %w", err))
+			return
+		}
+		if !filepath.IsAbs(req.Path) {
+			writeError(w, http.StatusBadRequest, errors.New("mount requests require an absolute path"))
+			return
+		}
+		vol, err = a.node.inspect(a.mounter, id, filepath.Clean(req.Path))
+	} else {
+		vol, err = a.node.stopInspecting(a.mounter, id)
+	}
+
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errCandidateNotFound):
+			code = http.StatusNotFound
+		case errors.Is(err, errNotAnImage):
+			code = http.StatusBadRequest
+		case errors.Is(err, errCandidateMounted):
+			code = http.StatusConflict
+		}
+		writeError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toCandidate(id, vol, a.node.deletedVolumes.lastPressureFactor(vol.Pool)))
+}
+
+func (req PinRequest) toPin() (*pin, error) {
+	if req.Owner == "" || req.Reason == "" {
+		return nil, errors.New("pins require an owner and a reason")
+	}
+
+	p := &pin{Owner: req.Owner, Reason: req.Reason}
+	if req.Expiry != "" {
+		if err := p.Expiry.UnmarshalText([]byte(req.Expiry)); err != nil {
+			return nil, fmt.Errorf("invalid expiry %q: %w", req.Expiry, err)
+		}
+	}
+	return p, nil
+}
+
+func toVolume(vol volume) Volume {
+	return Volume{
+		ID:         vol.ID,
+		Name:       vol.Name,
+		PodUUID:    vol.PodUUID,
+		Pool:       poolName(vol.Pool),
+		Path:       vol.Path,
+		AccessType: vol.AccessType.String(),
+		Size:       vol.Size,
+		Inodes:     vol.Inodes,
+		Retention:  vol.Retention,
+		OverLimit:  vol.OverLimit,
+		Retained:   vol.Retained,
+	}
+}
+
+func toCandidate(id string, vol *deletionCandidate, pressureFactor float64) Candidate {
+	c := Candidate{
+		ID:           id,
+		PodUUID:      vol.podUUID(),
+		Pool:         poolName(vol.Pool),
+		Path:         vol.Path,
+		AccessType:   vol.AccessType.String(),
+		DeleteTime:   vol.Time,
+		Lifespan:     vol.Lifespan,
+		SizeBytes:    vol.Size,
+		Inodes:       vol.Inodes,
+		EvictionTime: evictionTime(vol, pressureFactor),
+		Failures:     vol.Failures,
+		Stuck:        vol.Stuck,
+		InspectPath:  vol.InspectPath,
+		Viewers:      vol.Viewers,
+	}
+	if vol.Pin != nil {
+		c.PinOwner = vol.Pin.Owner
+		c.PinReason = vol.Pin.Reason
+		if !vol.Pin.Expiry.IsZero() {
+			expiry := vol.Pin.Expiry
+			c.PinExpiry = &expiry
+		}
+	}
+	return c
+}
+
+// allowMethod writes an error response and returns false unless the request uses one of the given methods.
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		glog.V(4).Infof("unable to write admin response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/mount-utils"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&payload).Encode(body))
+	}
+
+	req := httptest.NewRequest(method, path, &payload)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminPin(t *testing.T) {
+	n := newTestNode(t)
+	handler := newAdminServer(n, mount.NewFakeMounter(nil)).handler()
+
+	// Two expired volumes from the same pod and one from another pod
+	for _, c := range []struct{ id, pod string }{{"vol1", "pod1"}, {"vol2", "pod1"}, {"vol3", "pod2"}} {
+		path := fullpath(n.workdir, c.pod, c.id)
+		require.NoError(t, os.MkdirAll(path, 0750))
+		n.deletedVolumes.queue(c.id, deletionCandidate{
+			Time:     time.Now().Add(-time.Hour),
+			Lifespan: time.Minute,
+			Path:     path,
+			PodUUID:  c.pod,
+		})
+	}
+
+	rr := adminRequest(t, handler, http.MethodPost, "/v1/pods/pod1/pin", PinRequest{Owner: "oncall", Reason: "incident"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var resp PinResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, []string{"vol1", "vol2"}, resp.VolumeIDs)
+
+	n.deletedVolumes.prune(n.workdir, 0)
+	assert.Contains(t, n.deletedVolumes.candidates, "vol1", "pinned volume should not be pruned")
+	assert.Contains(t, n.deletedVolumes.candidates, "vol2", "pinned volume should not be pruned")
+	assert.NotContains(t, n.deletedVolumes.candidates, "vol3", "unpinned volume should be pruned")
+
+	persisted, err := loadDeletedVolumesFromPersistent(n.storage, deletedVolumesBucketName)
+	require.NoError(t, err)
+	require.NotNil(t, persisted["vol1"].Pin)
+	assert.Equal(t, "oncall", persisted["vol1"].Pin.Owner)
+
+	rr = adminRequest(t, handler, http.MethodDelete, "/v1/candidates/vol1/pin", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	n.deletedVolumes.prune(n.workdir, 0)
+	assert.Contains(t, n.deletedVolumes.candidates, "vol1", "volumes of a pod are kept along with its pinned volume")
+	assert.Contains(t, n.deletedVolumes.candidates, "vol2", "pinned volume should not be pruned")
+
+	// Expired pins no longer protect their volume
+	expiry := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	rr = adminRequest(t, handler, http.MethodPost, "/v1/candidates/vol2/pin", PinRequest{Owner: "oncall", Reason: "incident", Expiry: expiry})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	n.deletedVolumes.prune(n.workdir, 0)
+	assert.NotContains(t, n.deletedVolumes.candidates, "vol1", "unpinned volume should be pruned")
+	assert.NotContains(t, n.deletedVolumes.candidates, "vol2", "volume with an expired pin should be pruned")
+}
+
+func TestAdminPinErrors(t *testing.T) {
+	n := newTestNode(t)
+	handler := newAdminServer(n, mount.NewFakeMounter(nil)).handler()
+
+	n.deletedVolumes.queue("vol1", deletionCandidate{Time: time.Now(), Lifespan: time.Hour, Path: "/doesnt/exist"})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"unknownVolume", http.MethodPost, "/v1/candidates/vol2/pin", PinRequest{Owner: "a", Reason: "b"}, http.StatusNotFound},
+		{"unknownPod", http.MethodPost, "/v1/pods/pod2/pin", PinRequest{Owner: "a", Reason: "b"}, http.StatusNotFound},
+		{"missingOwner", http.MethodPost, "/v1/candidates/vol1/pin", PinRequest{Reason: "b"}, http.StatusBadRequest},
+		{"invalidExpiry", http.MethodPost, "/v1/candidates/vol1/pin", PinRequest{Owner: "a", Reason: "b", Expiry: "tomorrow"}, http.StatusBadRequest},
+		{"wrongMethod", http.MethodGet, "/v1/candidates/vol1/pin", nil, http.StatusMethodNotAllowed},
+		{"unknownPath", http.MethodPost, "/v1/candidates/vol1/other", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := adminRequest(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.code, rr.Code, rr.Body.String())
+		})
+	}
+}
+
+func TestAdminInspect(t *testing.T) {
+	n := newTestNode(t)
+	handler := newAdminServer(n, mount.NewFakeMounter(nil)).handler()
+
+	n.volumes["live1"] = volume{ID: "live1", PodUUID: "pod1", Size: gib, AccessType: mountAccess}
+	n.volumes["live2"] = volume{ID: "live2", PodUUID: "pod1", AccessType: blockAccess}
+
+	queued := time.Now().Add(-time.Hour).Truncate(time.Second)
+	n.deletedVolumes.queue("dead1", deletionCandidate{Time: queued, Lifespan: 4 * time.Hour, Path: "/doesnt/exist/pod2/dead1"})
+	n.deletedVolumes.lastPressure.Store(map[string]float64{defaultPoolName: 0.5})
+
+	rr := adminRequest(t, handler, http.MethodGet, "/v1/status", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var status Status
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&status))
+	assert.Equal(t, "node", status.NodeID)
+	assert.Equal(t, 2, status.Volumes)
+	assert.Equal(t, 1, status.Candidates)
+	assert.Equal(t, 0.5, status.PressureFactor)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/v1/volumes", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var volumes []Volume
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&volumes))
+	require.Len(t, volumes, 2)
+	assert.Equal(t, "live1", volumes[0].ID)
+	assert.Equal(t, "mount", volumes[0].AccessType)
+	assert.Equal(t, gib, volumes[0].Size)
+	assert.Equal(t, "block", volumes[1].AccessType)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/v1/volumes/live2", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = adminRequest(t, handler, http.MethodGet, "/v1/volumes/dead1", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+
+	// The eviction time reflects the pressure factor of the last prune round
+	rr = adminRequest(t, handler, http.MethodGet, "/v1/candidates", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var candidates []Candidate
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&candidates))
+	require.Len(t, candidates, 1)
+	assert.Equal(t, "dead1", candidates[0].ID)
+	assert.Equal(t, "pod2", candidates[0].PodUUID)
+	assert.True(t, queued.Add(2*time.Hour).Equal(candidates[0].EvictionTime), candidates[0].EvictionTime)
+
+	rr = adminRequest(t, handler, http.MethodGet, "/v1/candidates/dead2", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+
+	rr = adminRequest(t, handler, http.MethodPut, "/v1/candidates", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code, rr.Body.String())
+}
+
+func TestAdminForceDelete(t *testing.T) {
+	n := newTestNode(t)
+	handler := newAdminServer(n, mount.NewFakeMounter(nil)).handler()
+
+	for _, id := range []string{"vol1", "vol2", "vol3"} {
+		path := fullpath(n.workdir, "pod1", id)
+		require.NoError(t, os.MkdirAll(path, 0750))
+		n.deletedVolumes.queue(id, deletionCandidate{Time: time.Now(), Lifespan: time.Hour, Path: path, PodUUID: "pod1"})
+	}
+
+	// Stuck and pinned volumes are deleted when forced
+	n.deletedVolumes.queue("vol3", deletionCandidate{
+		Time:     time.Now(),
+		Lifespan: time.Hour,
+		Path:     fullpath(n.workdir, "pod1", "vol3"),
+		PodUUID:  "pod1",
+		Pin:      &pin{Owner: "oncall", Reason: "incident"},
+		Stuck:    true,
+	})
+
+	// A prune round leaves volumes within their afterlife alone
+	rr := adminRequest(t, handler, http.MethodPost, "/v1/prune", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp DeleteResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Empty(t, resp.VolumeIDs)
+	assert.Len(t, n.deletedVolumes.candidates, 3)
+
+	for _, id := range []string{"vol1", "vol3"} {
+		rr = adminRequest(t, handler, http.MethodDelete, "/v1/candidates/"+id, nil)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.NotContains(t, n.deletedVolumes.candidates, id)
+		assert.NoDirExists(t, fullpath(n.workdir, "pod1", id))
+	}
+	assert.Contains(t, n.deletedVolumes.candidates, "vol2")
+
+	persisted, err := loadDeletedVolumesFromPersistent(n.storage, deletedVolumesBucketName)
+	require.NoError(t, err)
+	assert.NotContains(t, persisted, "vol1")
+	assert.NotContains(t, persisted, "vol3")
+
+	rr = adminRequest(t, handler, http.MethodDelete, "/v1/candidates/vol1", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+
+	rr = adminRequest(t, handler, http.MethodGet, "/v1/prune", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code, rr.Body.String())
+}
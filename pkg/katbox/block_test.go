@@ -0,0 +1,225 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
+)
+
+// fakeLoopDevices keeps track of the files attached to loop devices without touching the host.
+type fakeLoopDevices struct {
+	volumepathhandler.BlockVolumePathHandler
+
+	lock      sync.Mutex
+	devices   map[string]string
+	next      int
+	detachErr error
+}
+
+func (f *fakeLoopDevices) AttachFileDevice(path string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	if device, ok := f.devices[path]; ok {
+		return device, nil
+	}
+	device := fmt.Sprintf("/dev/loop%d", f.next)
+	f.next++
+	f.devices[path] = device
+	return device, nil
+}
+
+func (f *fakeLoopDevices) DetachFileDevice(path string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.detachErr != nil {
+		return f.detachErr
+	}
+	delete(f.devices, path)
+	return nil
+}
+
+func (f *fakeLoopDevices) attached(path string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, ok := f.devices[path]
+	return ok
+}
+
+func withFakeLoopDevices(n *node) *fakeLoopDevices {
+	loop := &fakeLoopDevices{devices: make(map[string]string)}
+	n.loop = loop
+	n.deletedVolumes.loop = loop
+	return loop
+}
+
+func blockPublishRequest(targetDir, volID, podUUID string) *csi.NodePublishVolumeRequest {
+	req := publishRequest(targetDir, volID, podUUID)
+	req.VolumeCapability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	req.VolumeContext[sizeContext] = "1500Ki"
+	return req
+}
+
+func TestBlockVolumeLifecycle(t *testing.T) {
+	ns, mounter := newTestNodeServer(t)
+	n := ns.node
+	loop := withFakeLoopDevices(n)
+	targetDir := t.TempDir()
+	targetPath := filepath.Join(targetDir, "vol1")
+
+	_, err := ns.NodePublishVolume(context.Background(), blockPublishRequest(targetDir, "vol1", "pod1"))
+	require.NoError(t, err)
+
+	vol, err := n.volumeByID("vol1")
+	require.NoError(t, err)
+	assert.Equal(t, blockAccess, vol.AccessType)
+	assert.Equal(t, fullpath(n.workdir, "pod1", "vol1"), vol.Path)
+
+	// The backing file is rounded up to a whole number of mebibytes
+	info, err := os.Stat(vol.Path)
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+	assert.Equal(t, 2*mib, info.Size())
+	assert.True(t, loop.attached(vol.Path))
+
+	mountPoints, err := mounter.List()
+	require.NoError(t, err)
+	require.Len(t, mountPoints, 1)
+	assert.Equal(t, loop.devices[vol.Path], mountPoints[0].Device)
+	assert.Equal(t, targetPath, mountPoints[0].Path)
+
+	// Publishing again as a mount volume is refused
+	_, err = ns.NodePublishVolume(context.Background(), publishRequest(targetDir, "vol1", "pod1"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol1", TargetPath: targetPath})
+	require.NoError(t, err)
+
+	assert.NoFileExists(t, targetPath)
+	assert.False(t, loop.attached(vol.Path), "loop device should be detached on unpublish")
+	candidate, queued := n.deletedVolumes.get("vol1")
+	require.True(t, queued)
+	assert.Equal(t, blockAccess, candidate.AccessType)
+	assert.FileExists(t, vol.Path, "backing file should be kept for the afterlife")
+
+	_, err = n.deletedVolumes.forceDelete("vol1")
+	require.NoError(t, err)
+	assert.NoFileExists(t, vol.Path)
+}
+
+func TestBlockVolumeValidation(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	withFakeLoopDevices(ns.node)
+	targetDir := t.TempDir()
+
+	req := blockPublishRequest(targetDir, "vol1", "pod1")
+	delete(req.VolumeContext, sizeContext)
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req = blockPublishRequest(targetDir, "vol1", "pod1")
+	req.VolumeContext[inodesContext] = "100"
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = ns.node.volumeByID("vol1")
+	assert.Error(t, err, "invalid requests should not create a volume")
+}
+
+func TestBlockVolumeDetachFailure(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	n := ns.node
+	loop := withFakeLoopDevices(n)
+	targetDir := t.TempDir()
+
+	_, err := ns.NodePublishVolume(context.Background(), blockPublishRequest(targetDir, "vol1", "pod1"))
+	require.NoError(t, err)
+
+	// Unpublishing fails without queueing the volume so the kubelet retries
+	loop.detachErr = errors.New("device busy")
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol1", TargetPath: filepath.Join(targetDir, "vol1")})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = n.volumeByID("vol1")
+	assert.NoError(t, err)
+	assert.False(t, isQueued(n, "vol1"))
+
+	// The pruner doesn't remove a backing file it couldn't detach
+	vol, err := n.volumeByID("vol1")
+	require.NoError(t, err)
+	n.removeVolume("vol1")
+	n.deletedVolumes.queue("vol1", deletionCandidate{
+		Time:       time.Now().Add(-2 * time.Hour),
+		Lifespan:   time.Hour,
+		Path:       vol.Path,
+		AccessType: blockAccess,
+	})
+	deleted, _ := n.deletedVolumes.prune(n.workdir, 0)
+	assert.Empty(t, deleted)
+	assert.FileExists(t, vol.Path)
+	candidate, queued := n.deletedVolumes.get("vol1")
+	require.True(t, queued)
+	assert.Equal(t, 1, candidate.Failures)
+
+	loop.detachErr = nil
+	deleted, _ = n.deletedVolumes.prune(n.workdir, 0)
+	assert.Equal(t, []string{"vol1"}, deleted)
+	assert.NoFileExists(t, vol.Path)
+}
+
+func TestReattachLoopDevices(t *testing.T) {
+	n := newTestNode(t)
+	loop := withFakeLoopDevices(n)
+
+	path := fullpath(n.workdir, "pod1", "vol1")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	n.setVolume(volume{ID: "vol1", PodUUID: "pod1", Path: path, AccessType: blockAccess, Ephemeral: true})
+	publishTestVolume(t, n, "vol2", "pod1")
+
+	n.reattachLoopDevices()
+	assert.True(t, loop.attached(path))
+	assert.Len(t, loop.devices, 1, "mount volumes have no loop device")
+
+	// Orphaned backing files are adopted as block volumes
+	orphan := fullpath(n.workdir, "pod2", "orphan")
+	require.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0750))
+	require.NoError(t, os.WriteFile(orphan, nil, 0600))
+	n.reconcile(nil)
+	candidate, queued := n.deletedVolumes.get("orphan")
+	require.True(t, queued)
+	assert.Equal(t, blockAccess, candidate.AccessType)
+	assert.WithinDuration(t, time.Now(), candidate.Time, time.Minute)
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+// These tests are meant to be run with the race detector: go test -race ./...
+
+func newTestNodeServer(t *testing.T) (*nodeServer, *mount.FakeMounter) {
+	mounter := mount.NewFakeMounter(nil)
+	return &nodeServer{node: newTestNode(t), mounter: mounter}, mounter
+}
+
+func publishRequest(targetDir, volID, podUUID string) *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:   volID,
+		TargetPath: filepath.Join(targetDir, volID),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+		VolumeContext: map[string]string{
+			ephemeralContext: "true",
+			podUUIDContext:   podUUID,
+		},
+	}
+}
+
+// retryAborted calls op until it stops failing because of an overlapping operation on the same volume.
+func retryAborted(op func() error) error {
+	for {
+		err := op()
+		if status.Code(err) != codes.Aborted {
+			return err
+		}
+	}
+}
+
+func TestOverlappingOperationsAreAborted(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	targetDir := t.TempDir()
+
+	require.True(t, ns.node.locks.tryAcquire("vol1"))
+
+	_, err := ns.NodePublishVolume(context.Background(), publishRequest(targetDir, "vol1", "pod1"))
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: filepath.Join(targetDir, "vol1"),
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	// Other volumes are unaffected
+	_, err = ns.NodePublishVolume(context.Background(), publishRequest(targetDir, "vol2", "pod1"))
+	assert.NoError(t, err)
+
+	ns.node.locks.release("vol1")
+	_, err = ns.NodePublishVolume(context.Background(), publishRequest(targetDir, "vol1", "pod1"))
+	assert.NoError(t, err)
+}
+
+func TestConcurrentPublishUnpublishPrune(t *testing.T) {
+	const (
+		volumes = 32
+		callers = 4
+	)
+
+	ns, mounter := newTestNodeServer(t)
+	n := ns.node
+	targetDir := t.TempDir()
+	admin := newAdminServer(n, mounter).handler()
+
+	// Keep the pruner, soft limit checks, metrics and admin API busy while volumes come and go
+	done := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		registry := newMetricsRegistry(n)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			n.deletedVolumes.prune(n.workdir, 0.1)
+			n.checkSoftLimits()
+			_, err := registry.Gather()
+			assert.NoError(t, err)
+			for _, path := range []string{"/v1/status", "/v1/volumes", "/v1/candidates"} {
+				rr := adminRequest(t, admin, http.MethodGet, path, nil)
+				assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+			}
+		}
+	}()
+
+	// Every volume is published by several callers at once, as the kubelet may retry
+	run := func(op func(volID, podUUID string) error) {
+		var wg sync.WaitGroup
+		for i := 0; i < volumes; i++ {
+			volID, podUUID := fmt.Sprintf("vol%d", i), fmt.Sprintf("pod%d", i%4)
+			for c := 0; c < callers; c++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, retryAborted(func() error { return op(volID, podUUID) }))
+				}()
+			}
+		}
+		wg.Wait()
+	}
+
+	run(func(volID, podUUID string) error {
+		_, err := ns.NodePublishVolume(context.Background(), publishRequest(targetDir, volID, podUUID))
+		return err
+	})
+
+	assert.Len(t, n.listVolumes(), volumes)
+	mountPoints, err := mounter.List()
+	require.NoError(t, err)
+	assert.Len(t, mountPoints, volumes, "every volume should be mounted exactly once")
+
+	run(func(volID, podUUID string) error {
+		_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volID,
+			TargetPath: filepath.Join(targetDir, volID),
+		})
+		return err
+	})
+
+	close(done)
+	background.Wait()
+
+	assert.Empty(t, n.listVolumes())
+	mountPoints, err = mounter.List()
+	require.NoError(t, err)
+	assert.Empty(t, mountPoints)
+
+	// Volumes are within their afterlife so they all remain queued, unaffected by retried unpublish calls
+	for i := 0; i < volumes; i++ {
+		volID := fmt.Sprintf("vol%d", i)
+		vol, found := n.deletedVolumes.get(volID)
+		require.True(t, found, volID)
+		assert.Equal(t, fullpath(n.workdir, fmt.Sprintf("pod%d", i%4), volID), vol.Path)
+	}
+
+	persisted, err := loadVolumesFromPersistent(n.storage, volumesBucketName)
+	require.NoError(t, err)
+	assert.Empty(t, persisted)
+}
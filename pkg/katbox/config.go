@@ -0,0 +1,192 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Version and kind a configuration file must declare
+const (
+	ConfigAPIVersion = "katbox.csi.paypal.com/v1"
+	ConfigKind       = "KatboxConfiguration"
+)
+
+// config is the content of a configuration file. Durations are written the way flags take them, e.g. 12h.
+type config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	DriverName        string `json:"driverName"`
+	NodeID            string `json:"nodeID"`
+	Endpoint          string `json:"endpoint"`
+	Workdir           string `json:"workdir"`
+	MaxVolumesPerNode int64  `json:"maxVolumesPerNode"`
+
+	Pools        []poolConfig `json:"pools"`
+	TemplatesDir string       `json:"templatesDir"`
+	VolumeMode   string       `json:"volumeMode"`
+
+	AfterlifeSpan    metav1.Duration `json:"afterlifeSpan"`
+	MinAfterlifeSpan metav1.Duration `json:"minAfterlifeSpan"`
+	MaxAfterlifeSpan metav1.Duration `json:"maxAfterlifeSpan"`
+
+	PruneInterval      metav1.Duration `json:"pruneInterval"`
+	Headroom           float64         `json:"headroom"`
+	InodeHeadroom      float64         `json:"inodeHeadroom"`
+	DeleteTimeout      metav1.Duration `json:"deleteTimeout"`
+	MaxDeleteAttempts  int             `json:"maxDeleteAttempts"`
+	PruneStallMultiple int             `json:"pruneStallMultiple"`
+	EvictionPolicy     string          `json:"evictionPolicy"`
+	PressureCurve      string          `json:"pressureCurve"`
+	PressureFloor      float64         `json:"pressureFloor"`
+	CriticalHeadroom   float64         `json:"criticalHeadroom"`
+
+	SoftLimitInterval metav1.Duration `json:"softLimitInterval"`
+	ReconcileInterval metav1.Duration `json:"reconcileInterval"`
+
+	MetricsAddress string `json:"metricsAddress"`
+	AdminEndpoint  string `json:"adminEndpoint"`
+
+	Kubeconfig       string          `json:"kubeconfig"`
+	WatchPods        bool            `json:"watchPods"`
+	PodSweepInterval metav1.Duration `json:"podSweepInterval"`
+	EmitEvents       bool            `json:"emitEvents"`
+	EventQPS         float64         `json:"eventQPS"`
+	EventBurst       int             `json:"eventBurst"`
+}
+
+type poolConfig struct {
+	Name          string          `json:"name"`
+	Workdir       string          `json:"workdir"`
+	Headroom      *float64        `json:"headroom"`
+	AfterlifeSpan metav1.Duration `json:"afterlifeSpan"`
+}
+
+// LoadConfig applies the settings of a YAML or JSON configuration file on top of opts.
+// Settings missing from the file keep the value they have in opts while unknown settings are rejected.
+func LoadConfig(path string, opts *Options) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file: %w", err)
+	}
+
+	c := newConfig(opts)
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return fmt.Errorf("unable to parse configuration file %s: %w", path, err)
+	}
+
+	if c.APIVersion != ConfigAPIVersion || c.Kind != ConfigKind {
+		return fmt.Errorf("configuration file %s must be a %s %s, not a %s %s",
+			path, ConfigAPIVersion, ConfigKind, c.APIVersion, c.Kind)
+	}
+
+	c.apply(opts)
+	return nil
+}
+
+func newConfig(opts *Options) config {
+	var pools []poolConfig
+	for _, p := range opts.Pools {
+		pools = append(pools, poolConfig{
+			Name:          p.Name,
+			Workdir:       p.Workdir,
+			Headroom:      p.Headroom,
+			AfterlifeSpan: metav1.Duration{Duration: p.AfterlifeSpan},
+		})
+	}
+
+	return config{
+		DriverName:         opts.DriverName,
+		NodeID:             opts.NodeID,
+		Endpoint:           opts.Endpoint,
+		Workdir:            opts.Workdir,
+		MaxVolumesPerNode:  opts.MaxVolumesPerNode,
+		Pools:              pools,
+		TemplatesDir:       opts.TemplatesDir,
+		VolumeMode:         opts.VolumeMode,
+		AfterlifeSpan:      metav1.Duration{Duration: opts.AfterlifeSpan},
+		MinAfterlifeSpan:   metav1.Duration{Duration: opts.MinAfterlifeSpan},
+		MaxAfterlifeSpan:   metav1.Duration{Duration: opts.MaxAfterlifeSpan},
+		PruneInterval:      metav1.Duration{Duration: opts.PruneInterval},
+		Headroom:           opts.Headroom,
+		InodeHeadroom:      opts.InodeHeadroom,
+		DeleteTimeout:      metav1.Duration{Duration: opts.DeleteTimeout},
+		MaxDeleteAttempts:  opts.MaxDeleteAttempts,
+		PruneStallMultiple: opts.PruneStallMultiple,
+		EvictionPolicy:     opts.EvictionPolicy,
+		PressureCurve:      opts.PressureCurve,
+		PressureFloor:      opts.PressureFloor,
+		CriticalHeadroom:   opts.CriticalHeadroom,
+		SoftLimitInterval:  metav1.Duration{Duration: opts.SoftLimitInterval},
+		ReconcileInterval:  metav1.Duration{Duration: opts.ReconcileInterval},
+		MetricsAddress:     opts.MetricsAddress,
+		AdminEndpoint:      opts.AdminEndpoint,
+		Kubeconfig:         opts.Kubeconfig,
+		WatchPods:          opts.WatchPods,
+		PodSweepInterval:   metav1.Duration{Duration: opts.PodSweepInterval},
+		EmitEvents:         opts.EmitEvents,
+		EventQPS:           opts.EventQPS,
+		EventBurst:         opts.EventBurst,
+	}
+}
+
+func (c *config) apply(opts *Options) {
+	opts.DriverName = c.DriverName
+	opts.NodeID = c.NodeID
+	opts.Endpoint = c.Endpoint
+	opts.Workdir = c.Workdir
+	opts.MaxVolumesPerNode = c.MaxVolumesPerNode
+	opts.Pools = nil
+	for _, p := range c.Pools {
+		opts.Pools = append(opts.Pools, PoolOptions{
+			Name:          p.Name,
+			Workdir:       p.Workdir,
+			Headroom:      p.Headroom,
+			AfterlifeSpan: p.AfterlifeSpan.Duration,
+		})
+	}
+	opts.TemplatesDir = c.TemplatesDir
+	opts.VolumeMode = c.VolumeMode
+	opts.AfterlifeSpan = c.AfterlifeSpan.Duration
+	opts.MinAfterlifeSpan = c.MinAfterlifeSpan.Duration
+	opts.MaxAfterlifeSpan = c.MaxAfterlifeSpan.Duration
+	opts.PruneInterval = c.PruneInterval.Duration
+	opts.Headroom = c.Headroom
+	opts.InodeHeadroom = c.InodeHeadroom
+	opts.DeleteTimeout = c.DeleteTimeout.Duration
+	opts.MaxDeleteAttempts = c.MaxDeleteAttempts
+	opts.PruneStallMultiple = c.PruneStallMultiple
+	opts.EvictionPolicy = c.EvictionPolicy
+	opts.PressureCurve = c.PressureCurve
+	opts.PressureFloor = c.PressureFloor
+	opts.CriticalHeadroom = c.CriticalHeadroom
+	opts.SoftLimitInterval = c.SoftLimitInterval.Duration
+	opts.ReconcileInterval = c.ReconcileInterval.Duration
+	opts.MetricsAddress = c.MetricsAddress
+	opts.AdminEndpoint = c.AdminEndpoint
+	opts.Kubeconfig = c.Kubeconfig
+	opts.WatchPods = c.WatchPods
+	opts.PodSweepInterval = c.PodSweepInterval.Duration
+	opts.EmitEvents = c.EmitEvents
+	opts.EventQPS = c.EventQPS
+	opts.EventBurst = c.EventBurst
+}
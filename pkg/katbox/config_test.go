@@ -0,0 +1,221 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		expected func(o *Options)
+		err      string
+	}{
+		{
+			name: "yaml",
+			file: "katbox.yaml",
+			content: `apiVersion: katbox.csi.paypal.com/v1
+kind: KatboxConfiguration
+nodeID: node1
+afterlifeSpan: 6h
+pruneInterval: 30s
+headroom: 0.25
+inodeHeadroom: 0.05
+pressureCurve: "85%=0.5, 95%=0.1"
+pressureFloor: 0.2
+evictionPolicy: lru
+watchPods: true
+templatesDir: /csi-templates
+pools:
+- name: fast
+  workdir: /mnt/nvme/katbox
+  headroom: 0.2
+  afterlifeSpan: 1h
+- name: bulk
+  workdir: /mnt/hdd/katbox
+`,
+			expected: func(o *Options) {
+				headroom := 0.2
+				o.NodeID = "node1"
+				o.AfterlifeSpan = 6 * time.Hour
+				o.PruneInterval = 30 * time.Second
+				o.Headroom = 0.25
+				o.InodeHeadroom = 0.05
+				o.PressureCurve = "85%=0.5, 95%=0.1"
+				o.PressureFloor = 0.2
+				o.EvictionPolicy = "lru"
+				o.WatchPods = true
+				o.TemplatesDir = "/csi-templates"
+				o.Pools = []PoolOptions{
+					{Name: "fast", Workdir: "/mnt/nvme/katbox", Headroom: &headroom, AfterlifeSpan: time.Hour},
+					{Name: "bulk", Workdir: "/mnt/hdd/katbox"},
+				}
+			},
+		},
+		{
+			name:    "json",
+			file:    "katbox.json",
+			content: `{"apiVersion": "katbox.csi.paypal.com/v1", "kind": "KatboxConfiguration", "maxDeleteAttempts": 3, "eventQPS": 0.5}`,
+			expected: func(o *Options) {
+				o.MaxDeleteAttempts = 3
+				o.EventQPS = 0.5
+			},
+		},
+		{
+			name:    "missing version",
+			file:    "katbox.yaml",
+			content: "kind: KatboxConfiguration\nheadroom: 0.25\n",
+			err:     "must be a katbox.csi.paypal.com/v1 KatboxConfiguration",
+		},
+		{
+			name:    "unknown version",
+			file:    "katbox.yaml",
+			content: "apiVersion: katbox.csi.paypal.com/v2\nkind: KatboxConfiguration\n",
+			err:     "must be a katbox.csi.paypal.com/v1 KatboxConfiguration",
+		},
+		{
+			name:    "unknown setting",
+			file:    "katbox.yaml",
+			content: "apiVersion: katbox.csi.paypal.com/v1\nkind: KatboxConfiguration\nheadrom: 0.25\n",
+			err:     "unknown field",
+		},
+		{
+			name:    "invalid duration",
+			file:    "katbox.yaml",
+			content: "apiVersion: katbox.csi.paypal.com/v1\nkind: KatboxConfiguration\npruneInterval: often\n",
+			err:     "invalid duration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			err := LoadConfig(writeConfig(t, tt.file, tt.content), &opts)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+
+			// Settings missing from the file keep their defaults
+			expected := DefaultOptions()
+			tt.expected(&expected)
+			assert.Equal(t, expected, opts)
+		})
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *Options)
+		err    string
+	}{
+		{"valid", func(o *Options) {}, ""},
+		{"missing node id", func(o *Options) { o.NodeID = "" }, "no node id provided"},
+		{"headroom above 1", func(o *Options) { o.Headroom = 1.5 }, "headroom must be a value between 0 and 1.0"},
+		{"negative inode headroom", func(o *Options) { o.InodeHeadroom = -0.1 }, "inode headroom must be a value between 0 and 1.0"},
+		{"unknown pressure curve", func(o *Options) { o.PressureCurve = "quadratic" }, "unknown pressure curve"},
+		{"pressure floor above 1", func(o *Options) { o.PressureFloor = 1.5 }, "pressure floor must be a value between 0 and 1.0"},
+		{"zero prune interval", func(o *Options) { o.PruneInterval = 0 }, "prune interval must be positive"},
+		{"negative afterlife", func(o *Options) { o.AfterlifeSpan = -time.Hour }, "afterlife span cannot be negative"},
+		{"min above max afterlife", func(o *Options) {
+			o.MinAfterlifeSpan = 2 * time.Hour
+			o.MaxAfterlifeSpan = time.Hour
+		}, "minimum afterlife span cannot be greater than the maximum afterlife span"},
+		{"unknown eviction policy", func(o *Options) { o.EvictionPolicy = "random" }, "unknown eviction policy"},
+		{"negative event burst", func(o *Options) { o.EventBurst = -1 }, "event rate limits cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.NodeID = "node"
+			tt.modify(&opts)
+
+			err := opts.Validate()
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	opts := DefaultOptions()
+	opts.NodeID = "node"
+	opts.Workdir = t.TempDir()
+	opts.AdminEndpoint = ""
+
+	k, err := NewKatboxDriver(opts)
+	require.NoError(t, err)
+	n := k.nodeServer.node
+	defer n.storage.Close()
+
+	interval, headroom := n.deletedVolumes.settings.get()
+	assert.Equal(t, opts.PruneInterval, interval)
+	assert.Equal(t, opts.Headroom, headroom)
+	select {
+	case <-n.deletedVolumes.settings.reloaded:
+	default:
+	}
+
+	reloaded := opts
+	reloaded.PruneInterval = time.Minute
+	reloaded.Headroom = 0.3
+	reloaded.InodeHeadroom = 0.2
+	reloaded.AfterlifeSpan = time.Hour
+	require.NoError(t, k.Reload(reloaded))
+
+	interval, headroom = n.deletedVolumes.settings.get()
+	assert.Equal(t, time.Minute, interval)
+	assert.Equal(t, 0.3, headroom)
+	assert.Equal(t, 0.2, n.deletedVolumes.settings.getInodeHeadroom())
+	assert.Equal(t, opts.AfterlifeSpan, n.afterLifespan, "settings which aren't reloadable should be left alone")
+
+	// The pruner is woken up to pick up the new interval
+	select {
+	case <-n.deletedVolumes.settings.reloaded:
+	default:
+		t.Fatal("pruner should have been notified of the reload")
+	}
+
+	invalid := reloaded
+	invalid.Headroom = 2
+	assert.Error(t, k.Reload(invalid))
+	_, headroom = n.deletedVolumes.settings.get()
+	assert.Equal(t, 0.3, headroom, "invalid options should not be applied")
+}
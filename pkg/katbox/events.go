@@ -0,0 +1,117 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events recorded over a volume's lifecycle
+const (
+	volumePublished     = "VolumePublished"
+	volumePublishFailed = "VolumePublishFailed"
+	volumeQueued        = "VolumeQueued"
+	volumeDeleted       = "VolumeDeleted"
+	volumeEvictedEarly  = "VolumeEvictedEarly"
+	volumeDeleteFailed  = "VolumeDeleteFailed"
+	volumeOverLimit     = "VolumeOverLimit"
+	volumePinned        = "VolumePinned"
+	volumeUnpinned      = "VolumeUnpinned"
+)
+
+// podRef identifies the pod a volume belongs to.
+type podRef struct {
+	UID       string
+	Name      string
+	Namespace string
+}
+
+func (p podRef) String() string {
+	if p.Name == "" {
+		return p.UID
+	}
+	return p.Namespace + "/" + p.Name
+}
+
+// eventRecorder records Kubernetes events about volumes. A nil recorder records nothing.
+type eventRecorder struct {
+	recorder record.EventRecorder
+	nodeName string
+
+	// podExists reports whether a pod is still around, events about pods that are gone are recorded on the node.
+	// It is nil when pods aren't being watched in which case pods are assumed to exist.
+	podExists func(uid string) bool
+}
+
+// newEventRecorder returns a recorder which sends events to the API server. The number of events
+// about a single object is limited to burst, after which qps events are sent per second.
+func newEventRecorder(client kubernetes.Interface, nodeName, driverName string, qps float32, burst int) *eventRecorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{QPS: qps, BurstSize: burst})
+	broadcaster.StartLogging(glog.V(4).Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
+	return &eventRecorder{
+		recorder: broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName, Host: nodeName}),
+		nodeName: nodeName,
+	}
+}
+
+// podEvent records an event on the pod, or on the node if the pod no longer exists.
+func (r *eventRecorder) podEvent(pod podRef, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+
+	if pod.Name == "" || (r.podExists != nil && !r.podExists(pod.UID)) {
+		r.nodeEvent(pod, eventType, reason, messageFmt, args...)
+		return
+	}
+
+	r.recorder.Eventf(&v1.ObjectReference{
+		Kind:      "Pod",
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		UID:       types.UID(pod.UID),
+	}, eventType, reason, messageFmt, args...)
+}
+
+// nodeEvent records an event about one of the pod's volumes on the node.
+func (r *eventRecorder) nodeEvent(pod podRef, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+
+	message := fmt.Sprintf(messageFmt, args...)
+	if pod.UID != "" {
+		message = fmt.Sprintf("Pod %s: %s", pod, message)
+	}
+
+	// The kubelet uses the node's name as its UID in events as well
+	r.recorder.Event(&v1.ObjectReference{
+		Kind: "Node",
+		Name: r.nodeName,
+		UID:  types.UID(r.nodeName),
+	}, eventType, reason, message)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// objectRecorder remembers the object each event was recorded on.
+type objectRecorder struct {
+	*record.FakeRecorder
+	objects []*v1.ObjectReference
+}
+
+func (r *objectRecorder) Event(object runtime.Object, eventType, reason, message string) {
+	r.objects = append(r.objects, object.(*v1.ObjectReference))
+	r.FakeRecorder.Event(object, eventType, reason, message)
+}
+
+func (r *objectRecorder) Eventf(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	r.objects = append(r.objects, object.(*v1.ObjectReference))
+	r.FakeRecorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+func newTestEventRecorder(n *node) *objectRecorder {
+	recorder := &objectRecorder{FakeRecorder: record.NewFakeRecorder(100)}
+	n.events = &eventRecorder{recorder: recorder, nodeName: n.id}
+	n.deletedVolumes.events = n.events
+	return recorder
+}
+
+func nextEvent(t *testing.T, recorder *objectRecorder) (string, *v1.ObjectReference) {
+	select {
+	case event := <-recorder.Events:
+		object := recorder.objects[0]
+		recorder.objects = recorder.objects[1:]
+		return event, object
+	default:
+		t.Fatal("expected an event to be recorded")
+		return "", nil
+	}
+}
+
+func TestPublishEvents(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	recorder := newTestEventRecorder(ns.node)
+	targetDir := t.TempDir()
+
+	req := publishRequest(targetDir, "vol1", "uid1")
+	req.VolumeContext[podNameContext] = "pod1"
+	req.VolumeContext[podNamespaceContext] = "default"
+	req.VolumeContext[sizeContext] = "1Gi"
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err)
+
+	event, object := nextEvent(t, recorder)
+	assert.Equal(t, "Normal VolumePublished Published volume vol1 limited to 1Gi", event)
+	assert.Equal(t, "Pod", object.Kind)
+	assert.Equal(t, "default", object.Namespace)
+	assert.Equal(t, "pod1", object.Name)
+	assert.EqualValues(t, "uid1", object.UID)
+
+	req = publishRequest(targetDir, "vol2", "uid1")
+	req.VolumeContext[podNameContext] = "pod1"
+	req.VolumeContext[podNamespaceContext] = "default"
+	req.VolumeContext[sizeContext] = "lots"
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	require.Error(t, err)
+
+	event, object = nextEvent(t, recorder)
+	assert.Contains(t, event, "Warning VolumePublishFailed Unable to publish volume vol2: invalid")
+	assert.Equal(t, "pod1", object.Name)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: filepath.Join(targetDir, "vol1"),
+	})
+	require.NoError(t, err)
+
+	event, object = nextEvent(t, recorder)
+	candidate, _ := ns.node.deletedVolumes.get("vol1")
+	assert.Contains(t, event, "Normal VolumeQueued Volume vol1 queued for deletion, it is retained until "+
+		evictionTime(candidate, 1.0).Format(time.RFC3339))
+	assert.Equal(t, "pod1", object.Name)
+
+	// Unpublishing again doesn't queue the volume twice
+	ns.node.queueForDeletion("vol1", volume{ID: "vol1", PodUUID: "uid1", PodName: "pod1", PodNamespace: "default"})
+	assert.Empty(t, recorder.Events)
+}
+
+func TestEventsOfMissingPodsGoToTheNode(t *testing.T) {
+	n := newTestNode(t)
+	recorder := newTestEventRecorder(n)
+	n.events.podExists = func(uid string) bool { return uid == "uid1" }
+
+	pod := podRef{UID: "uid2", Name: "pod2", Namespace: "default"}
+	n.events.podEvent(pod, v1.EventTypeNormal, volumeQueued, "Volume %s queued", "vol1")
+
+	event, object := nextEvent(t, recorder)
+	assert.Equal(t, "Normal VolumeQueued Pod default/pod2: Volume vol1 queued", event)
+	assert.Equal(t, "Node", object.Kind)
+	assert.Equal(t, "node", object.Name)
+
+	// Volumes published without pod information can only be reported on the node
+	n.events.podEvent(podRef{UID: "uid1"}, v1.EventTypeNormal, volumeQueued, "Volume %s queued", "vol2")
+
+	event, object = nextEvent(t, recorder)
+	assert.Equal(t, "Normal VolumeQueued Pod uid1: Volume vol2 queued", event)
+	assert.Equal(t, "Node", object.Kind)
+
+	// A nil recorder records nothing
+	var events *eventRecorder
+	events.podEvent(pod, v1.EventTypeNormal, volumeQueued, "Volume %s queued", "vol3")
+	events.nodeEvent(pod, v1.EventTypeNormal, volumeQueued, "Volume %s queued", "vol3")
+}
+
+func TestPruneEvents(t *testing.T) {
+	n := newTestNode(t)
+	recorder := newTestEventRecorder(n)
+	pod := podRef{UID: "uid1", Name: "pod1", Namespace: "default"}
+
+	queue := func(id string, queued time.Time) {
+		path := fullpath(n.workdir, pod.UID, id)
+		require.NoError(t, os.MkdirAll(path, 0750))
+		n.deletedVolumes.queue(id, deletionCandidate{
+			Time:         queued,
+			Lifespan:     time.Hour,
+			Path:         path,
+			PodUUID:      pod.UID,
+			PodName:      pod.Name,
+			PodNamespace: pod.Namespace,
+		})
+	}
+
+	// Every candidate is evicted, oldest first, as the whole disk is treated as headroom
+	n.deletedVolumes.policy = oldestFirstPolicy{sizeOf: func(*deletionCandidate) int64 { return 0 }}
+	queue("expired", time.Now().Add(-2*time.Hour))
+	queue("early", time.Now())
+
+	deleted, _ := n.deletedVolumes.prune(n.workdir, 1.0)
+	require.Equal(t, []string{"expired", "early"}, deleted)
+
+	event, object := nextEvent(t, recorder)
+	assert.Equal(t, "Normal VolumeDeleted Pod default/pod1: Volume expired deleted at the end of its afterlife", event)
+	assert.Equal(t, "Node", object.Kind)
+
+	event, _ = nextEvent(t, recorder)
+	assert.Contains(t, event, "Warning VolumeEvictedEarly Pod default/pod1: Volume early deleted")
+	assert.Contains(t, event, "before the end of its afterlife due to disk pressure, pressure factor")
+
+	// A path nested under a regular file can never be removed
+	require.NoError(t, os.WriteFile(filepath.Join(n.workdir, "file"), nil, 0644))
+	n.deletedVolumes.queue("stuck", deletionCandidate{
+		Time:     time.Now().Add(-2 * time.Hour),
+		Lifespan: time.Hour,
+		Path:     filepath.Join(n.workdir, "file", "stuck"),
+		PodUUID:  pod.UID,
+	})
+	n.deletedVolumes.policy = nil
+	n.deletedVolumes.prune(n.workdir, 0.0)
+
+	event, _ = nextEvent(t, recorder)
+	assert.Contains(t, event, "Warning VolumeDeleteFailed Pod uid1: Unable to delete volume stuck")
+}
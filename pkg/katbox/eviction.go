@@ -0,0 +1,271 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/volume/util/fs"
+)
+
+// Names accepted by newEvictionPolicy
+const (
+	timeBasedEviction    = "time"
+	largestFirstEviction = "largest-first"
+	oldestFirstEviction  = "oldest-first"
+	lruEviction          = "lru"
+)
+
+// evictionPolicy decides which deletion candidates are removed from disk during a prune round.
+type evictionPolicy interface {
+	// victims returns the IDs of the candidates that should be deleted, in the order they should be deleted.
+	victims(now time.Time, candidates map[string]*deletionCandidate, disk diskState) []string
+}
+
+// diskState describes the utilization of the storage backing the working directory during a prune round.
+type diskState struct {
+	total          uint64
+	free           uint64
+	headroom       float64
+	inodes         uint64
+	freeInodes     uint64
+	inodeHeadroom  float64
+	pressureFactor float64
+}
+
+// deficit returns the number of bytes that need to be freed for free space to be back above the headroom.
+func (s diskState) deficit() int64 {
+	return shortfall(s.total, s.free, s.headroom)
+}
+
+// inodeDeficit returns the number of inodes that need to be freed for free inodes to be back above the inode headroom.
+func (s diskState) inodeDeficit() int64 {
+	return shortfall(s.inodes, s.freeInodes, s.inodeHeadroom)
+}
+
+func shortfall(total, free uint64, headroom float64) int64 {
+	headroomSpace := uint64(math.Ceil(float64(total) * headroom))
+	if free >= headroomSpace {
+		return 0
+	}
+	return int64(headroomSpace - free)
+}
+
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case timeBasedEviction, "":
+		return timeBasedPolicy{}, nil
+	case largestFirstEviction:
+		return largestFirstPolicy{sizeOf: cachedSize}, nil
+	case oldestFirstEviction:
+		return oldestFirstPolicy{sizeOf: cachedSize}, nil
+	case lruEviction:
+		return lruPolicy{sizeOf: cachedSize, lastAccess: candidateAccessTime}, nil
+	default:
+		return nil, fmt.Errorf(
+			"unknown eviction policy %q, must be one of %s, %s, %s or %s",
+			name, timeBasedEviction, largestFirstEviction, oldestFirstEviction, lruEviction)
+	}
+}
+
+// timeBasedPolicy evicts every candidate whose afterlife, shortened by the pressure factor, has passed.
+type timeBasedPolicy struct{}
+
+func (timeBasedPolicy) victims(now time.Time, candidates map[string]*deletionCandidate, disk diskState) []string {
+	var ids []string
+	expiry := make(map[string]time.Time)
+	for id, vol := range candidates {
+		// Check to see if the current has passed the time when we need to evict this volume from
+		// the underlying storage. The point in time is a combination of the pressure factor
+		// and the configured afterlife duration.
+		expiry[id] = evictionTime(vol, disk.pressureFactor)
+		if now.After(expiry[id]) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return byTime(ids[i], ids[j], expiry[ids[i]], expiry[ids[j]])
+	})
+	return ids
+}
+
+// largestFirstPolicy reclaims the space needed to get back above the headroom with as few deletions as possible.
+type largestFirstPolicy struct {
+	sizeOf func(*deletionCandidate) int64
+}
+
+func (p largestFirstPolicy) victims(now time.Time, candidates map[string]*deletionCandidate, disk diskState) []string {
+	sizes := make(map[string]int64)
+	return evictUntilFreed(now, candidates, disk, p.sizeOf, func(a, b string) bool {
+		for _, id := range []string{a, b} {
+			if _, found := sizes[id]; !found {
+				sizes[id] = p.sizeOf(candidates[id])
+			}
+		}
+		if sizes[a] != sizes[b] {
+			return sizes[a] > sizes[b]
+		}
+		return a < b
+	})
+}
+
+// oldestFirstPolicy evicts the candidates that were queued the longest ago until free space is back above the headroom.
+type oldestFirstPolicy struct {
+	sizeOf func(*deletionCandidate) int64
+}
+
+func (p oldestFirstPolicy) victims(now time.Time, candidates map[string]*deletionCandidate, disk diskState) []string {
+	return evictUntilFreed(now, candidates, disk, p.sizeOf, func(a, b string) bool {
+		return byTime(a, b, candidates[a].Time, candidates[b].Time)
+	})
+}
+
+// lruPolicy evicts the candidates that were least recently looked at until free space is back above the headroom.
+type lruPolicy struct {
+	sizeOf     func(*deletionCandidate) int64
+	lastAccess func(*deletionCandidate) time.Time
+}
+
+func (p lruPolicy) victims(now time.Time, candidates map[string]*deletionCandidate, disk diskState) []string {
+	accessed := make(map[string]time.Time)
+	return evictUntilFreed(now, candidates, disk, p.sizeOf, func(a, b string) bool {
+		for _, id := range []string{a, b} {
+			if _, found := accessed[id]; !found {
+				accessed[id] = p.lastAccess(candidates[id])
+			}
+		}
+		return byTime(a, b, accessed[a], accessed[b])
+	})
+}
+
+// evictUntilFreed returns every candidate whose full afterlife has passed followed by as many of the
+// remaining candidates, taken in the order defined by less, as needed to cover the disk's deficit in
+// bytes and in inodes. Inodes are counted from the last time each candidate was measured.
+func evictUntilFreed(
+	now time.Time,
+	candidates map[string]*deletionCandidate,
+	disk diskState,
+	sizeOf func(*deletionCandidate) int64,
+	less func(a, b string) bool,
+) []string {
+	var expired, remaining []string
+	for id, vol := range candidates {
+		if now.After(evictionTime(vol, 1.0)) {
+			expired = append(expired, id)
+		} else {
+			remaining = append(remaining, id)
+		}
+	}
+	sort.Strings(expired)
+
+	// Space freed by candidates that are expiring anyway counts towards the deficit
+	deficit, inodeDeficit := disk.deficit(), disk.inodeDeficit()
+	if deficit == 0 && inodeDeficit == 0 {
+		return expired
+	}
+	for _, id := range expired {
+		deficit -= sizeOf(candidates[id])
+		inodeDeficit -= candidates[id].Inodes
+	}
+
+	sort.Slice(remaining, func(i, j int) bool {
+		return less(remaining[i], remaining[j])
+	})
+
+	ids := expired
+	for _, id := range remaining {
+		if deficit <= 0 && inodeDeficit <= 0 {
+			break
+		}
+		ids = append(ids, id)
+		deficit -= sizeOf(candidates[id])
+		inodeDeficit -= candidates[id].Inodes
+	}
+	return ids
+}
+
+// evictionTime returns the point in time after which the candidate should be evicted
+// when its afterlife is scaled by the given pressure factor.
+func evictionTime(vol *deletionCandidate, pressureFactor float64) time.Time {
+	return vol.Time.Add(time.Duration(float64(vol.Lifespan) * pressureFactor))
+}
+
+// byTime orders two candidates by time, falling back to their IDs to keep the order stable.
+func byTime(a, b string, timeA, timeB time.Time) bool {
+	if !timeA.Equal(timeB) {
+		return timeA.Before(timeB)
+	}
+	return a < b
+}
+
+// candidateSize returns the number of bytes used by the candidate on disk.
+func candidateSize(vol *deletionCandidate) int64 {
+	usage, err := fs.DiskUsage(vol.Path)
+	if err != nil {
+		glog.V(4).Infof("unable to determine disk usage of %s: %s", vol.Path, err)
+	}
+	return usage.Bytes
+}
+
+// sizeRefreshInterval is how long the size measured for a candidate is trusted before it is measured again.
+const sizeRefreshInterval = time.Hour
+
+// measure records the number of bytes and inodes used by the candidate on disk.
+func (vol *deletionCandidate) measure(now time.Time) {
+	usage, err := fs.DiskUsage(vol.Path)
+	if err != nil {
+		glog.V(4).Infof("unable to determine disk usage of %s: %s", vol.Path, err)
+	}
+	vol.Size = usage.Bytes
+	vol.Inodes = usage.Inodes
+	vol.SizedAt = now
+}
+
+// sizeStale reports whether the candidate was never measured or was measured too long ago to be trusted.
+func (vol *deletionCandidate) sizeStale(now time.Time) bool {
+	return vol.SizedAt.IsZero() || now.Sub(vol.SizedAt) > sizeRefreshInterval
+}
+
+// cachedSize returns the size measured for the candidate, only walking its path if it was never measured.
+func cachedSize(vol *deletionCandidate) int64 {
+	if vol.SizedAt.IsZero() {
+		return candidateSize(vol)
+	}
+	return vol.Size
+}
+
+// candidateAccessTime returns the access time of the candidate's directory which is refreshed by
+// the stream server whenever a file inside the volume is served.
+func candidateAccessTime(vol *deletionCandidate) time.Time {
+	info, err := os.Stat(vol.Path)
+	if err != nil {
+		return vol.Time
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	}
+	return info.ModTime()
+}
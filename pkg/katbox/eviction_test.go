@@ -0,0 +1,166 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var evictionNow = time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// evictionCandidates returns a queue where "expired" has outlived its afterlife while the rest
+// are still within it. Candidates are ordered differently by size, age and last access.
+func evictionCandidates() map[string]*deletionCandidate {
+	return map[string]*deletionCandidate{
+		"expired": {Time: evictionNow.Add(-2 * time.Hour), Lifespan: time.Hour, Path: "expired"},
+		"small":   {Time: evictionNow.Add(-50 * time.Minute), Lifespan: time.Hour, Path: "small"},
+		"large":   {Time: evictionNow.Add(-10 * time.Minute), Lifespan: time.Hour, Path: "large"},
+		"medium":  {Time: evictionNow.Add(-35 * time.Minute), Lifespan: time.Hour, Path: "medium"},
+	}
+}
+
+var evictionSizes = map[string]int64{"expired": 10, "small": 100, "medium": 300, "large": 1000}
+
+var evictionAccess = map[string]time.Time{
+	"expired": evictionNow.Add(-time.Hour),
+	"small":   evictionNow.Add(-time.Minute),
+	"medium":  evictionNow.Add(-5 * time.Minute),
+	"large":   evictionNow.Add(-2 * time.Minute),
+}
+
+func fakeSize(vol *deletionCandidate) int64 {
+	return evictionSizes[vol.Path]
+}
+
+func fakeAccess(vol *deletionCandidate) time.Time {
+	return evictionAccess[vol.Path]
+}
+
+// Disk states with 1000 bytes of headroom space on a 10000 byte disk
+var (
+	noPressure    = diskState{total: 10000, free: 5000, headroom: .1, pressureFactor: 1.0}
+	smallPressure = diskState{total: 10000, free: 800, headroom: .1, pressureFactor: 0.8}
+	largePressure = diskState{total: 10000, free: 500, headroom: .1, pressureFactor: 0.5}
+	fullDisk      = diskState{total: 10000, free: 0, headroom: .1, pressureFactor: 0.0}
+)
+
+func Test_timeBasedPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		disk     diskState
+		expected []string
+	}{
+		{"noPressure", noPressure, []string{"expired"}},
+		{"smallPressure", smallPressure, []string{"expired", "small"}},
+		{"largePressure", largePressure, []string{"expired", "small", "medium"}},
+		{"fullDisk", fullDisk, []string{"expired", "small", "medium", "large"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			victims := timeBasedPolicy{}.victims(evictionNow, evictionCandidates(), tt.disk)
+			assert.Equal(t, tt.expected, victims, "Incorrect victims")
+		})
+	}
+}
+
+func Test_largestFirstPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		disk     diskState
+		expected []string
+	}{
+		{"noPressure", noPressure, []string{"expired"}},
+		{"smallPressure", smallPressure, []string{"expired", "large"}},
+		{"largePressure", largePressure, []string{"expired", "large"}},
+		{"fullDisk", fullDisk, []string{"expired", "large"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			victims := largestFirstPolicy{sizeOf: fakeSize}.victims(evictionNow, evictionCandidates(), tt.disk)
+			assert.Equal(t, tt.expected, victims, "Incorrect victims")
+		})
+	}
+}
+
+func Test_oldestFirstPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		disk     diskState
+		expected []string
+	}{
+		{"noPressure", noPressure, []string{"expired"}},
+		{"smallPressure", smallPressure, []string{"expired", "small", "medium"}},
+		{"largePressure", largePressure, []string{"expired", "small", "medium", "large"}},
+		{"fullDisk", fullDisk, []string{"expired", "small", "medium", "large"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			victims := oldestFirstPolicy{sizeOf: fakeSize}.victims(evictionNow, evictionCandidates(), tt.disk)
+			assert.Equal(t, tt.expected, victims, "Incorrect victims")
+		})
+	}
+}
+
+func Test_lruPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		disk     diskState
+		expected []string
+	}{
+		{"noPressure", noPressure, []string{"expired"}},
+		{"smallPressure", smallPressure, []string{"expired", "medium"}},
+		{"largePressure", largePressure, []string{"expired", "medium", "large"}},
+		{"fullDisk", fullDisk, []string{"expired", "medium", "large"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := lruPolicy{sizeOf: fakeSize, lastAccess: fakeAccess}
+			victims := policy.victims(evictionNow, evictionCandidates(), tt.disk)
+			assert.Equal(t, tt.expected, victims, "Incorrect victims")
+		})
+	}
+}
+
+func Test_newEvictionPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		expectErr bool
+	}{
+		{"default", "", false},
+		{"time", timeBasedEviction, false},
+		{"largestFirst", largestFirstEviction, false},
+		{"oldestFirst", oldestFirstEviction, false},
+		{"lru", lruEviction, false},
+		{"unknown", "random", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newEvictionPolicy(tt.policy)
+
+			if tt.expectErr {
+				assert.Error(t, err, "expected an error")
+			} else {
+				assert.NoError(t, err, "unexpected error")
+				assert.NotNil(t, policy, "expected a policy")
+			}
+		})
+	}
+}
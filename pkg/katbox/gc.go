@@ -18,14 +18,21 @@ package katbox
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ricochet2200/go-disk-usage/du"
 	bolt "go.etcd.io/bbolt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
 
 	"github.com/golang/glog"
 )
@@ -33,49 +40,229 @@ import (
 type deletedVolumes struct {
 	candidates map[string]*deletionCandidate
 	storage    *bolt.DB
+	quota      *projectQuota
+	policy     evictionPolicy
+	events     *eventRecorder
 	lock       sync.RWMutex
+
+	// pools holds the storage pools besides the default one, which lives in the working directory given to prune.
+	pools map[string]*storagePool
+
+	// loop detaches the loop devices of block and image volumes before their backing file is removed.
+	loop volumepathhandler.BlockVolumePathHandler
+
+	// deleteTimeout bounds how long a single deletion may block a prune round while
+	// maxDeleteAttempts is the number of failed deletions after which a candidate is considered stuck.
+	deleteTimeout     time.Duration
+	maxDeleteAttempts int
+
+	// curve turns the utilization of a pool into its pressure factor, which floor keeps from dropping too low.
+	curve pressureCurve
+	floor pressureFloor
+
+	// statFilesystem reports the usage of the filesystem backing a working directory, du is used when nil.
+	statFilesystem func(workdir string) filesystemUsage
+
+	// inFlight holds the outcome of deletions which outlived their timeout and are still running.
+	inFlight map[string]chan deletionResult
+
+	// lastRound holds the unix time in nanoseconds at which the last prune round finished.
+	lastRound int64
+
+	// lastPressure holds the pressure factor of every pool computed by the last prune round.
+	lastPressure atomic.Value
+
+	// lastReclaim holds the bytes every pool needed and got back during the last prune round.
+	lastReclaim atomic.Value
+
+	// pruneLock serializes prune rounds with deletions forced through the admin API.
+	pruneLock sync.Mutex
+
+	// settings holds the pruner settings which may be reloaded while the plugin runs.
+	settings pruneSettings
+}
+
+// pruneSettings holds how often the pruner runs and how much space and how many inodes it tries to keep free.
+type pruneSettings struct {
+	lock          sync.RWMutex
+	interval      time.Duration
+	headroom      float64
+	inodeHeadroom float64
+
+	// reloaded wakes the pruner up so a new interval takes effect right away.
+	reloaded chan struct{}
+}
+
+func (s *pruneSettings) get() (time.Duration, float64) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.interval, s.headroom
+}
+
+func (s *pruneSettings) getInodeHeadroom() float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.inodeHeadroom
+}
+
+func (s *pruneSettings) set(interval time.Duration, headroom, inodeHeadroom float64) {
+	s.lock.Lock()
+	s.interval = interval
+	s.headroom = headroom
+	s.inodeHeadroom = inodeHeadroom
+	s.lock.Unlock()
+
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
 }
 
 type deletionCandidate struct {
-	Time     time.Time     `json:"deleteTime"`
-	Lifespan time.Duration `json:"lifespan"`
-	Path     string        `json:"path"`
+	Time      time.Time     `json:"deleteTime"`
+	Lifespan  time.Duration `json:"lifespan"`
+	Path      string        `json:"path"`
+	PodUUID   string        `json:"podUUID,omitempty"`
+	ProjectID uint32        `json:"projectID,omitempty"`
+
+	// Pool is the storage pool the volume was created in. Records written before pools existed leave it empty.
+	Pool string `json:"pool,omitempty"`
+
+	// AccessType tells whether Path is a directory or a file that must be detached from its loop device first.
+	AccessType accessType `json:"accessType,omitempty"`
+
+	// FsType is the filesystem of image volumes, which may be mounted read only at InspectPath while they are retained.
+	FsType      string `json:"fsType,omitempty"`
+	InspectPath string `json:"inspectPath,omitempty"`
+
+	// Viewers are the volumes showing the candidate read only to other pods since AttachedAt.
+	Viewers    []string  `json:"viewers,omitempty"`
+	AttachedAt time.Time `json:"attachedAt,omitempty"`
+
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+
+	// Size is the number of bytes used by the candidate on disk as measured at SizedAt. It is measured when the
+	// candidate is queued and measured again once it grows stale and the pruner needs to know how much it frees.
+	// Inodes is the number of inodes it used at the same time.
+	Size    int64     `json:"size,omitempty"`
+	Inodes  int64     `json:"inodes,omitempty"`
+	SizedAt time.Time `json:"sizedAt,omitempty"`
+
+	// Pin keeps the candidate on disk past its afterlife and through disk pressure.
+	Pin *pin `json:"pin,omitempty"`
+
+	// Failures counts the deletion attempts that errored or timed out. Once it reaches the
+	// configured maximum the candidate is marked as Stuck and is no longer retried by the pruner.
+	Failures int  `json:"failures,omitempty"`
+	Stuck    bool `json:"stuck,omitempty"`
+}
+
+// pin records who asked for a retained volume to be kept around and why.
+type pin struct {
+	Owner  string `json:"owner"`
+	Reason string `json:"reason"`
+
+	// Expiry is the point in time after which the pin no longer applies. A zero value never expires.
+	Expiry time.Time `json:"expiry,omitempty"`
+}
+
+// active reports whether the pin still protects its candidate at the given time.
+func (p *pin) active(now time.Time) bool {
+	return p != nil && (p.Expiry.IsZero() || now.Before(p.Expiry))
+}
+
+var (
+	errCandidateNotFound = errors.New("volume is not queued for deletion")
+	errCandidateMounted  = errors.New("volume is mounted for inspection")
+)
+
+// poolReclaim describes how much space and how many inodes a prune round needed to free in a pool
+// and how much it actually freed.
+type poolReclaim struct {
+	target          int64
+	reclaimed       int64
+	inodeTarget     int64
+	reclaimedInodes int64
+}
+
+type deletionResult struct {
+	reclaimed int64
+	err       error
 }
 
 func (d *deletedVolumes) periodicCleanup(
 	done <-chan struct{},
-	interval time.Duration,
 	wg *sync.WaitGroup,
-	headroom float64,
 	workdir string,
 ) {
+	defer wg.Done()
+
+	interval, _ := d.settings.get()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
+		current, headroom := d.settings.get()
+		if current != interval {
+			glog.Infof("prune interval changed from %s to %s", interval, current)
+			interval = current
+			ticker.Reset(interval)
+		}
+
+		d.prune(workdir, headroom)
+		atomic.StoreInt64(&d.lastRound, time.Now().UnixNano())
+
 		select {
 		case <-done:
 			if err := d.storage.Close(); err != nil {
 				glog.Info("unable to close persistent storage ", err)
 			}
-			wg.Done()
 			return
-		default:
-			d.prune(workdir, headroom)
-			time.Sleep(interval)
+		case <-ticker.C:
+		case <-d.settings.reloaded:
 		}
 	}
 }
 
-func (d *deletedVolumes) queue(id string, vol deletionCandidate) {
+// lastRoundTime returns the time at which the pruner last finished a round.
+func (d *deletedVolumes) lastRoundTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&d.lastRound))
+}
+
+// queue adds the candidate to the deletion queue. It returns false if the volume was already queued
+// or could not be persisted.
+func (d *deletedVolumes) queue(id string, vol deletionCandidate) bool {
 	// Check if an entry for deletion already exists
 	d.lock.RLock()
 	_, found := d.candidates[id]
 	d.lock.RUnlock()
 
 	if found {
-		return
+		return false
+	}
+
+	// Measure the volume once up front so the pruner knows how much space it frees without walking it every round
+	if vol.SizedAt.IsZero() {
+		vol.measure(time.Now())
 	}
 
 	// Write ahead persist to local storage the volume that will be entering our deletion queue
-	err := d.storage.Update(func(tx *bolt.Tx) error {
+	if err := d.persist(id, vol); err != nil {
+		glog.Infof("failed to persist "+id+" at "+vol.Path, ": ", err)
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.candidates[id] = &vol
+	return true
+}
+
+// persist writes the deletion candidate to local storage, replacing any previous record.
+func (d *deletedVolumes) persist(id string, vol deletionCandidate) error {
+	return d.storage.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(deletedVolumesBucketName))
 		if bucket == nil {
 			return fmt.Errorf("bucket %s does not exist", deletedVolumesBucketName)
@@ -91,21 +278,138 @@ func (d *deletedVolumes) queue(id string, vol deletionCandidate) {
 			return fmt.Errorf("unable to insert volume into database: %w", err)
 		}
 
+		if err := indexCandidate(tx, vol.podUUID(), id); err != nil {
+			return fmt.Errorf("unable to index volume by pod: %w", err)
+		}
 		return nil
 	})
+}
+
+func (vol *deletionCandidate) pod() podRef {
+	return podRef{UID: vol.podUUID(), Name: vol.PodName, Namespace: vol.PodNamespace}
+}
 
+// podUUID returns the UUID of the pod that owned the candidate. Candidates queued before the
+// pod UUID was recorded fall back to the layout of the working directory.
+func (vol *deletionCandidate) podUUID() string {
+	if vol.PodUUID != "" {
+		return vol.PodUUID
+	}
+	return filepath.Base(filepath.Dir(vol.Path))
+}
+
+// setPin pins the candidates or unpins them when p is nil. Every ID must be queued for deletion.
+func (d *deletedVolumes) setPin(ids []string, p *pin) error {
+	if len(ids) == 0 {
+		return errCandidateNotFound
+	}
+
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	for _, id := range ids {
+		vol, err := d.update(id, func(vol *deletionCandidate) { vol.Pin = p })
+		if errors.Is(err, errCandidateNotFound) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("unable to persist pin for %s: %w", id, err)
+		}
+
+		if p != nil {
+			glog.Infof("pinned %s at %s for %s: %s", id, vol.Path, p.Owner, p.Reason)
+			d.events.nodeEvent(vol.pod(), v1.EventTypeNormal, volumePinned, "Volume %s pinned by %s: %s", id, p.Owner, p.Reason)
+		} else {
+			glog.Infof("unpinned %s at %s", id, vol.Path)
+			d.events.nodeEvent(vol.pod(), v1.EventTypeNormal, volumeUnpinned, "Volume %s unpinned", id)
+		}
+	}
+
+	return nil
+}
+
+// recordFailure counts a failed deletion attempt against the candidate and marks it as stuck
+// once it has failed too many times.
+func (d *deletedVolumes) recordFailure(id string) {
+	_, err := d.update(id, func(vol *deletionCandidate) {
+		vol.Failures++
+		if d.maxDeleteAttempts > 0 && vol.Failures >= d.maxDeleteAttempts {
+			vol.Stuck = true
+			glog.Errorf("giving up on deleting %s at %s after %d attempts", id, vol.Path, vol.Failures)
+		}
+	})
 	if err != nil {
-		glog.Infof("failed to persist "+id+" at "+vol.Path, ": ", err)
-		return
+		glog.Infof("failed to persist failure of %s: %s", id, err)
+	}
+}
+
+// stuckCount returns the number of candidates the pruner gave up on.
+func (d *deletedVolumes) stuckCount() int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	count := 0
+	for _, vol := range d.candidates {
+		if vol != nil && vol.Stuck {
+			count++
+		}
 	}
+	return count
+}
 
+// delete removes the candidate's path from disk, returning the number of bytes reclaimed.
+// A deletion that does not finish within deleteTimeout keeps running in the background and its
+// outcome is collected by the next attempt for the same candidate instead of starting another one.
+func (d *deletedVolumes) delete(id string, vol deletionCandidate) (int64, error) {
 	d.lock.Lock()
-	defer d.lock.Unlock()
+	if d.inFlight == nil {
+		d.inFlight = make(map[string]chan deletionResult)
+	}
+	result, found := d.inFlight[id]
+	if !found {
+		result = make(chan deletionResult, 1)
+		d.inFlight[id] = result
+		go func() {
+			// The backing file of a block or image volume stays in use for as long as a loop device refers to it
+			if vol.AccessType.usesLoopDevice() {
+				if err := d.loop.DetachFileDevice(vol.Path); err != nil {
+					result <- deletionResult{err: fmt.Errorf("unable to detach loop device: %w", err)}
+					return
+				}
+			}
 
-	d.candidates[id] = &vol
+			// Measure the volume before it goes away so we can account for the space reclaimed,
+			// unless it was measured recently enough
+			if vol.sizeStale(time.Now()) {
+				vol.measure(time.Now())
+			}
+			result <- deletionResult{reclaimed: vol.Size, err: os.RemoveAll(vol.Path)}
+		}()
+	}
+	d.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if d.deleteTimeout > 0 {
+		timer := time.NewTimer(d.deleteTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case res := <-result:
+		d.lock.Lock()
+		delete(d.inFlight, id)
+		d.lock.Unlock()
+		return res.reclaimed, res.err
+	case <-timeout:
+		return 0, fmt.Errorf("deletion did not finish within %s", d.deleteTimeout)
+	}
 }
 
+// remove drops the candidate from the queue, along with the directory of its pod once it was the last one in it.
 func (d *deletedVolumes) remove(id string) {
+	vol, found := d.get(id)
+
 	err := d.storage.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(deletedVolumesBucketName))
 
@@ -113,6 +417,9 @@ func (d *deletedVolumes) remove(id string) {
 		if err != nil {
 			return fmt.Errorf("unable to delete %s from permanent storage: %s", id, err)
 		}
+		if found {
+			return unindexCandidate(tx, vol.podUUID(), id)
+		}
 		return nil
 	})
 
@@ -122,27 +429,39 @@ func (d *deletedVolumes) remove(id string) {
 	}
 
 	d.lock.Lock()
-	defer d.lock.Unlock()
-
 	delete(d.candidates, id)
+	d.lock.Unlock()
+
+	if found {
+		d.removePodDirectory(vol)
+	}
 }
 
-func (d *deletedVolumes) prune(workdir string, headroom float64) {
-	glog.V(2).Info("number of volumes queued for deletion: ", len(d.candidates))
+// prune deletes the candidates picked by the eviction policy. It returns the IDs of the deleted
+// candidates along with the number of bytes they freed.
+func (d *deletedVolumes) prune(workdir string, headroom float64) ([]string, int64) {
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
 
 	// Only get the time once since this results in a syscall
 	// This may mean that some volumes may need to wait until next cycle to be pruned
 	currentTime := time.Now()
-
-	// Determine pressure factor based on underlying storage utilization
-	diskUsage := du.NewDiskUsage(workdir)
-	pressureFactor, err := pressureFactor(diskUsage.Size(), diskUsage.Free(), headroom)
-	if err != nil {
-		glog.Info("error calculating pressure factor, setting pressure factor to default value of 0.10 ", err)
-		pressureFactor = 0.1
+	var reclaimed int64
+	defer func() {
+		pruneDuration.Observe(time.Since(currentTime).Seconds())
+		pruneReclaimedBytes.Observe(float64(reclaimed))
+	}()
+
+	// Determine the pressure factor of every pool based on the utilization of its underlying storage
+	disks := d.poolDisks(workdir, headroom, d.settings.getInodeHeadroom())
+	factors := make(map[string]float64)
+	for name, disk := range disks {
+		factors[name] = disk.pressureFactor
 	}
+	d.lastPressure.Store(factors)
 
-	glog.Info("disk pressure factor being used for this prune round: ", pressureFactor)
+	// Deletions which timed out during earlier rounds may have finished since
+	deleted, reclaimed := d.collectDeletions()
 
 	// Create a deep copy of the maps for safe reading
 	candidatesCopy := make(map[string]*deletionCandidate)
@@ -152,8 +471,12 @@ func (d *deletedVolumes) prune(workdir string, headroom float64) {
 	}
 	d.lock.RUnlock()
 
+	glog.V(2).Info("number of volumes queued for deletion: ", len(candidatesCopy))
+
 	// Iterate over the copy of the candidates list since iterating over the original
 	// provides no concurrency safety and attempting to use locks leads to a deadlock in many code paths.
+	eligible := make(map[string]*deletionCandidate)
+	keptPods := make(map[string]bool)
 	for id, vol := range candidatesCopy {
 		if vol == nil {
 			continue
@@ -163,29 +486,410 @@ func (d *deletedVolumes) prune(workdir string, headroom float64) {
 			glog.Infof("Deletion candidate volume ID: %v\n%+v", id, vol)
 		}
 
-		// Short circuit if the path doesn't exist
+		// Pinned volumes stay on disk, their space is still accounted for by the disk usage
+		// so other candidates are evicted sooner to make up for them.
+		if vol.Pin.active(currentTime) {
+			glog.V(4).Infof("skipping %v at %v as it is pinned by %s", id, vol.Path, vol.Pin.Owner)
+			keptPods[vol.podUUID()] = true
+			continue
+		}
+
+		if vol.InspectPath != "" {
+			glog.V(4).Infof("skipping %v at %v as it is mounted for inspection at %v", id, vol.Path, vol.InspectPath)
+			keptPods[vol.podUUID()] = true
+			continue
+		}
+
+		if len(vol.Viewers) > 0 {
+			glog.V(4).Infof("skipping %v at %v as it is attached read only to %v", id, vol.Path, vol.Viewers)
+			keptPods[vol.podUUID()] = true
+			continue
+		}
+
+		// Short circuit if the path doesn't exist, which also lets go of stuck candidates removed by hand
 		if _, err := os.Stat(vol.Path); os.IsNotExist(err) {
 			glog.Infof("removing %v from queue as path %v does not exist", id, vol.Path)
-			d.remove(id)
+			d.drop(id, vol)
+			continue
 		}
 
-		// Check to see if the current has passed the time when we need to evict this volume from
-		// the underlying storage. The point in time is a combination of the pressure factor
-		// and the configured afterlife duration.
-		if currentTime.After(vol.Time.Add(time.Duration(float64(vol.Lifespan) * pressureFactor))) {
-			err := os.RemoveAll(vol.Path)
+		if vol.Stuck {
+			glog.V(4).Infof("skipping %v at %v as it is stuck after %d failed deletions", id, vol.Path, vol.Failures)
+			keptPods[vol.podUUID()] = true
+			continue
+		}
+
+		eligible[id] = vol
+	}
+
+	// A pod's volumes are evicted together, so the volumes of a pod that has one of them kept are kept as well
+	pods := make(map[string][]string)
+	for id, vol := range eligible {
+		if keptPods[vol.podUUID()] {
+			glog.V(4).Infof("skipping %v at %v as another volume of pod %s is kept", id, vol.Path, vol.podUUID())
+			delete(eligible, id)
+			continue
+		}
+		pods[vol.podUUID()] = append(pods[vol.podUUID()], id)
+	}
+	for _, ids := range pods {
+		sort.Strings(ids)
+	}
+
+	// Each pool is pruned on its own as freeing space in one doesn't relieve pressure in another
+	byPool := make(map[string]map[string]*deletionCandidate)
+	poolOf := make(map[string]string)
+	for id, vol := range eligible {
+		name := poolName(vol.Pool)
+		if _, ok := disks[name]; !ok {
+			glog.Warningf("pool %s of %v no longer exists, pruning it along with the default pool", name, id)
+			name = defaultPoolName
+		}
+		if byPool[name] == nil {
+			byPool[name] = make(map[string]*deletionCandidate)
+		}
+		byPool[name][id] = vol
+		poolOf[id] = name
+	}
+
+	// Pools below their headroom have to know how much each candidate frees, so stale sizes are measured again
+	remaining := make(map[string]int64)
+	remainingInodes := make(map[string]int64)
+	// A curve such as "85%=0.5" shortens the afterlife before the pool is short of space, the shortened
+	// afterlife then decides alone which candidates are due since there is no deficit to work off
+	dueFactor := make(map[string]float64)
+	for name, disk := range disks {
+		remaining[name] = disk.deficit()
+		remainingInodes[name] = disk.inodeDeficit()
+		dueFactor[name] = 1.0
+		if remaining[name] > 0 || remainingInodes[name] > 0 {
+			for id, vol := range d.refreshSizes(currentTime, byPool[name]) {
+				byPool[name][id] = vol
+				eligible[id] = vol
+			}
+		} else {
+			dueFactor[name] = disk.pressureFactor
+		}
+	}
+
+	policy := d.policy
+	if policy == nil {
+		policy = timeBasedPolicy{}
+	}
+
+	var victims []string
+	chosen := make(map[string]bool)
+	for _, name := range append([]string{defaultPoolName}, sortedPoolNames(d.pools)...) {
+		// Candidates at the end of their afterlife go first so the space they free counts towards the deficit
+		var early []string
+		for _, id := range policy.victims(currentTime, byPool[name], disks[name]) {
+			chosen[id] = true
+			if currentTime.Before(evictionTime(eligible[id], 1.0)) {
+				early = append(early, id)
+			} else {
+				victims = append(victims, id)
+			}
+		}
+		victims = append(victims, early...)
+	}
+
+	attempted := make(map[string]bool)
+	freed := make(map[string]int64)
+	freedInodes := make(map[string]int64)
+	for _, victim := range victims {
+		if attempted[victim] {
+			continue
+		}
+
+		// Evicting early is only worth it for as long as the pool is short of space
+		name := poolOf[victim]
+		if remaining[name] <= 0 && remainingInodes[name] <= 0 && currentTime.Before(evictionTime(eligible[victim], dueFactor[name])) {
+			glog.V(4).Infof("skipping %v as pool %s is back above its headroom", victim, name)
+			continue
+		}
+
+		// The rest of the pod's volumes go along with the victim, whichever pool they are in
+		for _, id := range append([]string{victim}, pods[eligible[victim].podUUID()]...) {
+			if attempted[id] {
+				continue
+			}
+			attempted[id] = true
+			vol := eligible[id]
+
+			bytes, err := d.evict(id, vol)
 			if err != nil {
 				glog.Infof("unable to delete "+id+" at "+vol.Path, ": ", err)
+				d.events.nodeEvent(vol.pod(), v1.EventTypeWarning, volumeDeleteFailed, "Unable to delete volume %s: %s", id, err)
+				d.recordFailure(id)
 				continue
 			}
+			reclaimed += bytes
+			remaining[poolOf[id]] -= bytes
+			remainingInodes[poolOf[id]] -= vol.Inodes
+			freed[poolOf[id]] += bytes
+			freedInodes[poolOf[id]] += vol.Inodes
+			deleted = append(deleted, id)
+
+			if chosen[id] {
+				d.recordEviction(currentTime, id, vol, disks[poolOf[id]])
+			} else {
+				d.events.nodeEvent(vol.pod(), v1.EventTypeNormal, volumeDeleted,
+					"Volume %s deleted along with volume %s of the same pod", id, victim)
+			}
+		}
+	}
 
-			// Attempt to remove PodUUID directory if empty.
-			// We ignore the error here because this will correctly fail when a pod with multiple katbox volumes
-			// attempts to delete the parent directory. Only the last remaining volume being deleted should succeed.
-			_ = os.Remove(filepath.Dir(vol.Path))
+	reclaims := make(map[string]poolReclaim)
+	for name, disk := range disks {
+		reclaims[name] = poolReclaim{
+			target:          disk.deficit(),
+			reclaimed:       freed[name],
+			inodeTarget:     disk.inodeDeficit(),
+			reclaimedInodes: freedInodes[name],
+		}
+		if disk.deficit() > 0 || freed[name] > 0 {
+			glog.Infof("pool %s needed %d bytes to get back above its headroom, reclaimed %d bytes",
+				name, disk.deficit(), freed[name])
+		}
+		if disk.inodeDeficit() > 0 {
+			glog.Infof("pool %s needed %d inodes to get back above its inode headroom, reclaimed %d inodes",
+				name, disk.inodeDeficit(), freedInodes[name])
+		}
+		pruneTargetBytes.WithLabelValues(name).Set(float64(disk.deficit()))
+		pruneLastReclaimedBytes.WithLabelValues(name).Set(float64(freed[name]))
+		pruneTargetInodes.WithLabelValues(name).Set(float64(disk.inodeDeficit()))
+		pruneLastReclaimedInodes.WithLabelValues(name).Set(float64(freedInodes[name]))
+	}
+	d.lastReclaim.Store(reclaims)
+
+	return deleted, reclaimed
+}
+
+// refreshSizes measures the candidates whose size is stale again and returns the updated ones.
+func (d *deletedVolumes) refreshSizes(now time.Time, candidates map[string]*deletionCandidate) map[string]*deletionCandidate {
+	refreshed := make(map[string]*deletionCandidate)
+	for id, vol := range candidates {
+		if !vol.sizeStale(now) {
+			continue
+		}
+
+		measured := *vol
+		measured.measure(now)
+		glog.V(4).Infof("measured %v at %v again: %d bytes", id, vol.Path, measured.Size)
+
+		// Only the size is written back, the candidate may have been pinned or retained while it was measured
+		updated, err := d.update(id, func(vol *deletionCandidate) {
+			vol.Size, vol.Inodes, vol.SizedAt = measured.Size, measured.Inodes, measured.SizedAt
+		})
+		if err != nil {
+			glog.Infof("failed to persist size of "+id+" at "+vol.Path, ": ", err)
+			continue
+		}
+		refreshed[id] = updated
+	}
+	return refreshed
+}
+
+// lastPoolReclaim returns the bytes the pool needed and got back during the last prune round.
+func (d *deletedVolumes) lastPoolReclaim(pool string) poolReclaim {
+	reclaims, _ := d.lastReclaim.Load().(map[string]poolReclaim)
+	return reclaims[pool]
+}
+
+// recordEviction records an event telling whether the candidate was evicted early because of disk pressure.
+func (d *deletedVolumes) recordEviction(currentTime time.Time, id string, vol *deletionCandidate, disk diskState) {
+	if expiry := evictionTime(vol, 1.0); currentTime.Before(expiry) {
+		d.events.nodeEvent(vol.pod(), v1.EventTypeWarning, volumeEvictedEarly,
+			"Volume %s deleted %s before the end of its afterlife due to disk pressure, pressure factor %.2f",
+			id, expiry.Sub(currentTime).Round(time.Second), disk.pressureFactor)
+	} else {
+		d.events.nodeEvent(vol.pod(), v1.EventTypeNormal, volumeDeleted, "Volume %s deleted at the end of its afterlife", id)
+	}
+}
+
+// poolDisks returns the state of the storage backing every pool. The default pool lives in workdir
+// and pools without a headroom of their own use the given one. Every pool uses the same inode headroom.
+func (d *deletedVolumes) poolDisks(workdir string, headroom, inodeHeadroom float64) map[string]diskState {
+	stat := d.statFilesystem
+	if stat == nil {
+		stat = diskUsage
+	}
 
-			glog.Infof("deleted " + id + " at " + vol.Path)
-			d.remove(id)
+	disks := map[string]diskState{defaultPoolName: d.poolDisk(defaultPoolName, stat(workdir), headroom, inodeHeadroom)}
+	for name, p := range d.pools {
+		poolHeadroom := headroom
+		if p.headroom != nil {
+			poolHeadroom = *p.headroom
 		}
+		disks[name] = d.poolDisk(name, stat(p.workdir), poolHeadroom, inodeHeadroom)
+	}
+	return disks
+}
+
+// filesystemUsage describes the size of a filesystem and how much of it is free, in bytes and in inodes.
+type filesystemUsage struct {
+	total      uint64
+	free       uint64
+	inodes     uint64
+	freeInodes uint64
+}
+
+func diskUsage(workdir string) filesystemUsage {
+	usage := du.NewDiskUsage(workdir)
+	fsUsage := filesystemUsage{total: usage.Size(), free: usage.Free()}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(workdir, &stat); err != nil {
+		glog.Warningf("unable to determine inode usage of %s: %s", workdir, err)
+		return fsUsage
+	}
+	fsUsage.inodes = stat.Files
+	fsUsage.freeInodes = stat.Ffree
+	return fsUsage
+}
+
+// poolDisk computes the pressure factor of a pool as the lowest of the ones derived from its free space and
+// from its free inodes, so that whichever runs out first shortens the afterlife of its candidates.
+func (d *deletedVolumes) poolDisk(name string, usage filesystemUsage, headroom, inodeHeadroom float64) diskState {
+	curve := d.curve
+	if curve == nil {
+		curve = linearCurve{}
+	}
+
+	bytePressure, err := curve.factor(usage.total, usage.free, headroom)
+	if err != nil {
+		glog.Info("error calculating pressure factor, setting pressure factor to default value of 0.10 ", err)
+		bytePressure = 0.1
+	}
+
+	// Filesystems without a fixed number of inodes report none, they can't run out of them
+	inodePressure, err := curve.factor(usage.inodes, usage.freeInodes, inodeHeadroom)
+	if err != nil {
+		glog.Info("error calculating inode pressure factor, setting inode pressure factor to default value of 0.10 ", err)
+		inodePressure = 0.1
+	}
+
+	pressureFactor := d.floor.apply(math.Min(bytePressure, inodePressure), usage)
+	glog.Infof("disk pressure factor being used for this prune round in pool %s: %v (bytes %v, inodes %v)",
+		name, pressureFactor, bytePressure, inodePressure)
+	pressureFactorGauge.WithLabelValues(name).Set(pressureFactor)
+	resourcePressureFactorGauge.WithLabelValues(name, "bytes").Set(bytePressure)
+	resourcePressureFactorGauge.WithLabelValues(name, "inodes").Set(inodePressure)
+
+	return diskState{
+		total:          usage.total,
+		free:           usage.free,
+		headroom:       headroom,
+		inodes:         usage.inodes,
+		freeInodes:     usage.freeInodes,
+		inodeHeadroom:  inodeHeadroom,
+		pressureFactor: pressureFactor,
+	}
+}
+
+// get returns the candidate queued under the ID, if any.
+func (d *deletedVolumes) get(id string) (*deletionCandidate, bool) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	vol, found := d.candidates[id]
+	return vol, found && vol != nil
+}
+
+// forceDelete deletes a candidate right away regardless of its afterlife, pin or stuck state.
+// Candidates mounted for inspection or attached to other pods have to be unmounted first.
+func (d *deletedVolumes) forceDelete(id string) (int64, error) {
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	vol, found := d.get(id)
+	if !found {
+		return 0, fmt.Errorf("%s: %w", id, errCandidateNotFound)
+	}
+	if vol.InspectPath != "" {
+		return 0, fmt.Errorf("%s at %s: %w", id, vol.InspectPath, errCandidateMounted)
+	}
+	if len(vol.Viewers) > 0 {
+		return 0, fmt.Errorf("%s attached to %v: %w", id, vol.Viewers, errCandidateMounted)
+	}
+
+	glog.Infof("forcing deletion of %v at %v", id, vol.Path)
+	return d.evict(id, vol)
+}
+
+// evict removes the candidate from disk, releases its quota and drops it from the queue.
+func (d *deletedVolumes) evict(id string, vol *deletionCandidate) (int64, error) {
+	bytes, err := d.delete(id, *vol)
+	if err != nil {
+		return 0, err
+	}
+
+	glog.Infof("deleted " + id + " at " + vol.Path)
+	d.drop(id, vol)
+	return bytes, nil
+}
+
+// drop releases the quota of a candidate which is gone from disk and drops it from the queue.
+func (d *deletedVolumes) drop(id string, vol *deletionCandidate) {
+	quota := d.quota
+	if p, ok := d.pools[vol.Pool]; ok {
+		quota = p.quota
+	}
+	if err := quota.release(vol.ProjectID); err != nil {
+		glog.Warningf("unable to release quota for %s: %s", id, err)
+	}
+
+	d.remove(id)
+}
+
+// collectDeletions picks up the outcome of deletions which outlived their timeout during earlier rounds.
+// Candidates whose deletion finished in the background are dropped from the queue, stuck or not, while
+// the others start over the next time they are evicted. It returns the IDs of the dropped candidates
+// along with the number of bytes they freed.
+func (d *deletedVolumes) collectDeletions() ([]string, int64) {
+	finished := make(map[string]deletionResult)
+	d.lock.Lock()
+	for id, result := range d.inFlight {
+		select {
+		case res := <-result:
+			finished[id] = res
+			delete(d.inFlight, id)
+		default:
+		}
+	}
+	d.lock.Unlock()
+
+	var deleted []string
+	var reclaimed int64
+	for id, res := range finished {
+		vol, found := d.get(id)
+		if !found {
+			continue
+		}
+		if res.err != nil {
+			glog.Infof("background deletion of %v at %v failed: %s", id, vol.Path, res.err)
+			continue
+		}
+
+		glog.Infof("deleted %v at %v after its deletion outlived the timeout", id, vol.Path)
+		d.events.nodeEvent(vol.pod(), v1.EventTypeNormal, volumeDeleted, "Volume %s deleted after outliving the deletion timeout", id)
+		d.drop(id, vol)
+		deleted = append(deleted, id)
+		reclaimed += res.reclaimed
+	}
+	return deleted, reclaimed
+}
+
+// lastPressureFactor returns the pressure factor of the pool computed by the last prune round,
+// or 1.0 if no round has finished yet.
+func (d *deletedVolumes) lastPressureFactor(pool string) float64 {
+	factors, _ := d.lastPressure.Load().(map[string]float64)
+	if factor, ok := factors[poolName(pool)]; ok {
+		return factor
+	}
+	// Candidates of pools which no longer exist are pruned along with the default pool
+	if factor, ok := factors[defaultPoolName]; ok {
+		return factor
 	}
+	return 1.0
 }
@@ -17,13 +17,23 @@ limitations under the License.
 package katbox
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 )
 
 func TestDelete(t *testing.T) {
-	deleteQueue := deletedVolumes{candidates: make(map[string]*deletionCandidate), lock: sync.RWMutex{}}
+	workdir := t.TempDir()
+	db, err := initializePermanentStorage(filepath.Join(workdir, "deletedVolumes.db"), deletedVolumesBucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	deleteQueue := deletedVolumes{candidates: make(map[string]*deletionCandidate), lock: sync.RWMutex{}, storage: db}
 	deleteQueue.queue("volume1", deletionCandidate{
 		Time:     time.Now(),
 		Lifespan: time.Second * 5,
@@ -42,7 +52,161 @@ func TestDelete(t *testing.T) {
 	})
 
 	for len(deleteQueue.candidates) > 0 {
-		deleteQueue.prune()
+		deleteQueue.prune(workdir, 0.1)
 		time.Sleep(time.Second * 1)
 	}
 }
+
+func TestDeleteStuck(t *testing.T) {
+	workdir := t.TempDir()
+	db, err := initializePermanentStorage(filepath.Join(workdir, "deletedVolumes.db"), deletedVolumesBucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A path nested under a regular file can never be removed
+	if err := ioutil.WriteFile(filepath.Join(workdir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deleteQueue := deletedVolumes{
+		candidates:        make(map[string]*deletionCandidate),
+		storage:           db,
+		deleteTimeout:     time.Second,
+		maxDeleteAttempts: 3,
+	}
+	deleteQueue.queue("volume1", deletionCandidate{
+		Time:     time.Now().Add(-time.Hour),
+		Lifespan: time.Second,
+		Path:     filepath.Join(workdir, "file", "volume1"),
+	})
+
+	for i := 1; i <= 4; i++ {
+		deleteQueue.prune(workdir, 0.1)
+
+		candidate := deleteQueue.candidates["volume1"]
+		if candidate == nil {
+			t.Fatal("candidate should not have been removed from the queue")
+		}
+
+		expected := i
+		if expected > 3 {
+			expected = 3
+		}
+		if candidate.Failures != expected {
+			t.Fatalf("expected %d failures, got %d", expected, candidate.Failures)
+		}
+		if candidate.Stuck != (i >= 3) {
+			t.Fatalf("unexpected stuck state %v after %d rounds", candidate.Stuck, i)
+		}
+	}
+
+	if deleteQueue.stuckCount() != 1 {
+		t.Fatalf("expected a single stuck candidate, got %d", deleteQueue.stuckCount())
+	}
+
+	persisted, err := loadDeletedVolumesFromPersistent(db, deletedVolumesBucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !persisted["volume1"].Stuck {
+		t.Fatal("stuck state should have been persisted")
+	}
+}
+
+func TestDeleteStuckVanished(t *testing.T) {
+	workdir := t.TempDir()
+	db, err := initializePermanentStorage(filepath.Join(workdir, "deletedVolumes.db"), deletedVolumesBucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	deleteQueue := deletedVolumes{candidates: make(map[string]*deletionCandidate), storage: db}
+	deleteQueue.queue("volume1", deletionCandidate{
+		Time:     time.Now(),
+		Lifespan: time.Hour,
+		Path:     filepath.Join(workdir, "volume1"),
+		Stuck:    true,
+	})
+
+	// A finished deletion which outlived its timeout is collected on the next round
+	path := filepath.Join(workdir, "volume2")
+	if err := os.Mkdir(path, 0750); err != nil {
+		t.Fatal(err)
+	}
+	deleteQueue.queue("volume2", deletionCandidate{
+		Time:     time.Now(),
+		Lifespan: time.Hour,
+		Path:     path,
+		Stuck:    true,
+	})
+	result := make(chan deletionResult, 1)
+	result <- deletionResult{}
+	deleteQueue.inFlight = map[string]chan deletionResult{"volume2": result}
+
+	deleteQueue.prune(workdir, 0.1)
+
+	if len(deleteQueue.candidates) != 0 {
+		t.Fatalf("expected vanished and collected candidates to be dropped, got %d left", len(deleteQueue.candidates))
+	}
+	if len(deleteQueue.inFlight) != 0 {
+		t.Fatal("finished deletion should have been collected")
+	}
+
+	persisted, err := loadDeletedVolumesFromPersistent(db, deletedVolumesBucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persisted) != 0 {
+		t.Fatalf("expected no persisted candidates, got %d", len(persisted))
+	}
+}
+
+func TestUpdatesKeepConcurrentChanges(t *testing.T) {
+	workdir := t.TempDir()
+	db, err := initializePermanentStorage(filepath.Join(workdir, "deletedVolumes.db"), deletedVolumesBucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	deleteQueue := deletedVolumes{candidates: make(map[string]*deletionCandidate), storage: db, maxDeleteAttempts: 3}
+	queuedAt := time.Now()
+	deleteQueue.queue("volume1", deletionCandidate{
+		Time:     queuedAt,
+		Lifespan: time.Minute,
+		Path:     workdir,
+	})
+
+	// A prune round measuring the candidate from its own snapshot while an admin pins and retains it
+	snapshot := map[string]*deletionCandidate{"volume1": deleteQueue.candidates["volume1"]}
+	if err := deleteQueue.setPin([]string{"volume1"}, &pin{Owner: "alice", Reason: "debugging"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := deleteQueue.retain([]string{"volume1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	deleteQueue.refreshSizes(time.Now(), snapshot)
+	deleteQueue.recordFailure("volume1")
+
+	persisted, err := loadDeletedVolumesFromPersistent(db, deletedVolumesBucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vol := range []*deletionCandidate{deleteQueue.candidates["volume1"], persisted["volume1"]} {
+		if vol.Pin == nil || vol.Pin.Owner != "alice" {
+			t.Fatal("pin should have survived the size refresh and the failed attempt")
+		}
+		if vol.Lifespan < time.Hour {
+			t.Fatalf("retention should have survived the size refresh, lifespan is %s", vol.Lifespan)
+		}
+		if vol.SizedAt.IsZero() {
+			t.Fatal("size should have been measured")
+		}
+		if vol.Failures != 1 {
+			t.Fatalf("expected a single failure, got %d", vol.Failures)
+		}
+	}
+}
@@ -19,8 +19,13 @@ limitations under the License.
 package katbox
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -29,12 +34,22 @@ import (
 type identityServer struct {
 	name    string
 	version string
+
+	// node and pruneStallMultiple are used to determine whether the plugin is ready to serve requests.
+	// The pruner has stalled when it hasn't finished a round in pruneStallMultiple prune intervals.
+	node               *node
+	pruneStallMultiple int
+
+	// initErr is the reason the node failed to initialize, if it did.
+	initErr error
 }
 
-func NewIdentityServer(name, version string) *identityServer {
+func NewIdentityServer(name, version string, n *node, pruneStallMultiple int) *identityServer {
 	return &identityServer{
-		name:    name,
-		version: version,
+		name:               name,
+		version:            version,
+		node:               n,
+		pruneStallMultiple: pruneStallMultiple,
 	}
 }
 
@@ -56,7 +71,23 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	var err error
+	if ids.node == nil {
+		err = errors.New("node failed to initialize")
+		if ids.initErr != nil {
+			err = fmt.Errorf("node failed to initialize: %w", ids.initErr)
+		}
+	} else {
+		interval, _ := ids.node.deletedVolumes.settings.get()
+		err = ids.node.checkHealth(interval * time.Duration(ids.pruneStallMultiple))
+	}
+
+	if err != nil {
+		glog.Warningf("plugin is not ready: %s", err)
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
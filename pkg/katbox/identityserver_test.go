@@ -0,0 +1,97 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProbe(t *testing.T) {
+	workdir := t.TempDir()
+	db, err := initializePermanentStorage(filepath.Join(workdir, "deletedVolumes.db"), deletedVolumesBucketName, volumesBucketName)
+	require.NoError(t, err)
+	defer db.Close()
+
+	n := &node{
+		workdir:        workdir,
+		storage:        db,
+		deletedVolumes: deletedVolumes{storage: db, lastRound: time.Now().UnixNano()},
+	}
+	n.deletedVolumes.settings.set(5*time.Second, 0.1, 0)
+	ids := NewIdentityServer("katbox", "test", n, 12)
+
+	// notReady asserts the probe fails with a reason containing the given text
+	notReady := func(ids *identityServer, reason, msg string) {
+		_, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err), msg)
+		assert.Contains(t, status.Convert(err).Message(), reason, msg)
+	}
+
+	resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+	require.NoError(t, err)
+	assert.True(t, resp.GetReady().GetValue(), "healthy node should be ready")
+
+	n.deletedVolumes.lastRound = time.Now().Add(-2 * time.Minute).UnixNano()
+	notReady(ids, "pruner", "stalled pruner should not be ready")
+	n.deletedVolumes.lastRound = time.Now().UnixNano()
+
+	n.workdir = filepath.Join(workdir, "missing")
+	notReady(ids, "missing", "unwritable working directory should not be ready")
+	n.workdir = workdir
+
+	require.NoError(t, db.Close())
+	notReady(ids, "persistent storage", "closed persistent storage should not be ready")
+
+	entries, err := os.ReadDir(workdir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "probe should not leave files behind")
+
+	notReady(NewIdentityServer("katbox", "test", nil, 12), "node failed to initialize", "missing node should not be ready")
+
+	failed := NewIdentityServer("katbox", "test", nil, 12)
+	failed.initErr = errors.New("unable to open persistent storage: timeout")
+	notReady(failed, "unable to open persistent storage: timeout", "the reason the node failed should be reported")
+}
+
+func TestProbeReportsInitFailure(t *testing.T) {
+	opts := DefaultOptions()
+	opts.NodeID = "node"
+	opts.Workdir = t.TempDir()
+	opts.AdminEndpoint = ""
+
+	// A directory in place of the database keeps bolt from opening it
+	require.NoError(t, os.Mkdir(filepath.Join(opts.Workdir, "deletedVolumes.db"), 0750))
+
+	k, err := NewKatboxDriver(opts)
+	require.NoError(t, err, "the driver should still be created to answer probes")
+	assert.Nil(t, k.nodeServer.node)
+
+	_, err = k.idServer.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "unable to open persistent storage")
+}
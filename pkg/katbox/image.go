@@ -0,0 +1,200 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+)
+
+// imageFsTypes are the filesystems image volumes may be formatted with.
+var imageFsTypes = map[string]bool{"ext4": true, "xfs": true}
+
+var errNotAnImage = errors.New("only image volumes can be mounted for inspection")
+
+// createImage creates a sparse image file of the given size at path and formats it with fsType.
+// Like block volumes, the size is rounded up to a whole number of mebibytes. An image left behind without a record
+// may hold the data of its pod, so it is never truncated or formatted again.
+func createImage(path string, size int64, fsType string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("image %s already exists without a record", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create image: %w", err)
+	}
+	err = f.Truncate(roundUpToMiB(size))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		args := []string{"-q", path}
+		if fsType == "ext4" {
+			// mkfs.ext4 asks for confirmation before formatting anything but a block device
+			args = []string{"-F", "-q", path}
+		}
+
+		var out []byte
+		out, err = utilexec.New().Command("mkfs."+fsType, args...).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("failed to format image with %s: %v, %v", fsType, err, string(out))
+		}
+	}
+
+	if err != nil {
+		if err2 := os.Remove(path); err2 != nil {
+			glog.Errorf("failed to cleanup image %s: %v", path, err2)
+		}
+		return err
+	}
+	return nil
+}
+
+// mountImage attaches the image of the volume to a loop device and mounts it at the target path.
+func (ns *nodeServer) mountImage(vol volume, targetPath string, readOnly bool, mountFlags []string) error {
+	loopDevice, err := ns.node.loop.AttachFileDevice(vol.Path)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to attach image %s to a loop device: %v", vol.Path, err)
+	}
+
+	options := append([]string{}, mountFlags...)
+	if readOnly {
+		options = append(options, "ro")
+	}
+	if err := ns.mounter.Mount(loopDevice, targetPath, vol.FsType, options); err != nil {
+		if err2 := ns.node.loop.DetachFileDevice(vol.Path); err2 != nil {
+			glog.Errorf("unable to detach %s: %s", vol.Path, err2)
+		}
+		return status.Errorf(codes.Internal, "failed to mount image %s at %s: %v", vol.Path, targetPath, err)
+	}
+	return nil
+}
+
+// expandImage grows the image of the volume to the given size, rounded up to a whole number of mebibytes, and
+// then grows the filesystem mounted at volumePath to fill it.
+func (ns *nodeServer) expandImage(vol volume, volumePath string, size int64) error {
+	if err := os.Truncate(vol.Path, roundUpToMiB(size)); err != nil {
+		return status.Errorf(codes.Internal, "failed to grow image %s: %v", vol.Path, err)
+	}
+
+	loopDevice, err := ns.node.loop.AttachFileDevice(vol.Path)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get the loop device of %s: %v", vol.Path, err)
+	}
+
+	// The loop device keeps the size the image had when it was attached until told otherwise
+	if out, err := ns.exec.Command("losetup", "-c", loopDevice).CombinedOutput(); err != nil {
+		return status.Errorf(codes.Internal, "failed to refresh the size of %s: %v, %v", loopDevice, err, string(out))
+	}
+
+	if _, err := mount.NewResizeFs(ns.exec).Resize(loopDevice, volumePath); err != nil {
+		return status.Errorf(codes.Internal, "failed to grow the filesystem of %s: %v", vol.ID, err)
+	}
+	return nil
+}
+
+// inspect mounts the image of a retained volume read only at path so it can be looked at before it is pruned.
+// The pruner leaves the volume alone until it is unmounted.
+func (n *node) inspect(mounter mount.Interface, id, path string) (*deletionCandidate, error) {
+	d := &n.deletedVolumes
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	vol, found := d.get(id)
+	if !found {
+		return nil, fmt.Errorf("%s: %w", id, errCandidateNotFound)
+	}
+	if vol.AccessType != imageAccess || vol.FsType == "" {
+		return nil, fmt.Errorf("%s: %w", id, errNotAnImage)
+	}
+	if vol.InspectPath == path {
+		return vol, nil
+	}
+	if vol.InspectPath != "" {
+		return nil, fmt.Errorf("%s at %s: %w", id, vol.InspectPath, errCandidateMounted)
+	}
+
+	loopDevice, err := n.loop.AttachFileDevice(vol.Path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to attach %s to a loop device: %w", vol.Path, err)
+	}
+
+	err = os.MkdirAll(path, 0750)
+	if err == nil {
+		err = mounter.Mount(loopDevice, path, vol.FsType, []string{"ro"})
+	}
+	if err != nil {
+		if err2 := n.loop.DetachFileDevice(vol.Path); err2 != nil {
+			glog.Errorf("unable to detach %s: %s", vol.Path, err2)
+		}
+		return nil, fmt.Errorf("unable to mount %s at %s: %w", vol.Path, path, err)
+	}
+
+	glog.Infof("mounted %s at %s read only for inspection", id, path)
+	return d.setInspectPath(id, path)
+}
+
+// stopInspecting unmounts the image of a retained volume mounted by inspect, handing it back to the pruner.
+func (n *node) stopInspecting(mounter mount.Interface, id string) (*deletionCandidate, error) {
+	d := &n.deletedVolumes
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	vol, found := d.get(id)
+	if !found {
+		return nil, fmt.Errorf("%s: %w", id, errCandidateNotFound)
+	}
+	if vol.InspectPath == "" {
+		return vol, nil
+	}
+
+	if err := mount.CleanupMountPoint(vol.InspectPath, mounter, false); err != nil {
+		return nil, fmt.Errorf("unable to unmount %s: %w", vol.InspectPath, err)
+	}
+	if err := n.loop.DetachFileDevice(vol.Path); err != nil {
+		return nil, fmt.Errorf("unable to detach %s: %w", vol.Path, err)
+	}
+
+	glog.Infof("unmounted %s from %s", id, vol.InspectPath)
+	return d.setInspectPath(id, "")
+}
+
+// setInspectPath records where the candidate is mounted for inspection, or that it no longer is when path is empty.
+func (d *deletedVolumes) setInspectPath(id, path string) (*deletionCandidate, error) {
+	d.lock.RLock()
+	vol, found := d.candidates[id]
+	d.lock.RUnlock()
+
+	if !found || vol == nil {
+		return nil, fmt.Errorf("%s: %w", id, errCandidateNotFound)
+	}
+
+	updated := *vol
+	updated.InspectPath = path
+	if err := d.replace(id, updated); err != nil {
+		return nil, fmt.Errorf("unable to persist inspection mount of %s: %w", id, err)
+	}
+	return &updated, nil
+}
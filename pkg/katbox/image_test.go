@@ -0,0 +1,185 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+func imagePublishRequest(targetDir, volID, podUUID, fsType string) *csi.NodePublishVolumeRequest {
+	req := publishRequest(targetDir, volID, podUUID)
+	req.VolumeCapability.GetMount().FsType = fsType
+	req.VolumeContext[sizeContext] = "8Mi"
+	return req
+}
+
+func TestImageVolumeLifecycle(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+
+	ns, mounter := newTestNodeServer(t)
+	n := ns.node
+	loop := withFakeLoopDevices(n)
+	targetDir := t.TempDir()
+	targetPath := filepath.Join(targetDir, "vol1")
+
+	_, err := ns.NodePublishVolume(context.Background(), imagePublishRequest(targetDir, "vol1", "pod1", "ext4"))
+	require.NoError(t, err)
+
+	vol, err := n.volumeByID("vol1")
+	require.NoError(t, err)
+	assert.Equal(t, imageAccess, vol.AccessType)
+	assert.Equal(t, "ext4", vol.FsType)
+
+	info, err := os.Stat(vol.Path)
+	require.NoError(t, err)
+	assert.Equal(t, 8*mib, info.Size())
+	assert.True(t, loop.attached(vol.Path))
+
+	mountPoints, err := mounter.List()
+	require.NoError(t, err)
+	require.Len(t, mountPoints, 1)
+	assert.Equal(t, loop.devices[vol.Path], mountPoints[0].Device)
+	assert.Equal(t, targetPath, mountPoints[0].Path)
+	assert.Equal(t, "ext4", mountPoints[0].Type)
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol1", TargetPath: targetPath})
+	require.NoError(t, err)
+	assert.False(t, loop.attached(vol.Path), "loop device should be detached on unpublish")
+
+	candidate, queued := n.deletedVolumes.get("vol1")
+	require.True(t, queued)
+	assert.Equal(t, imageAccess, candidate.AccessType)
+	assert.Equal(t, "ext4", candidate.FsType)
+	assert.FileExists(t, vol.Path, "image should be kept for the afterlife")
+
+	// The retained image can be mounted read only for inspection
+	admin := newAdminServer(n, mounter).handler()
+	inspectPath := filepath.Join(t.TempDir(), "inspect")
+	rr := adminRequest(t, admin, http.MethodPost, "/v1/candidates/vol1/mount", MountRequest{Path: inspectPath})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp Candidate
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, inspectPath, resp.InspectPath)
+	assert.Equal(t, "image", resp.AccessType)
+
+	mountPoints, err = mounter.List()
+	require.NoError(t, err)
+	require.Len(t, mountPoints, 1)
+	assert.Equal(t, inspectPath, mountPoints[0].Path)
+	assert.Contains(t, mountPoints[0].Opts, "ro")
+
+	// Mounting it elsewhere or deleting it is refused while it is mounted, and the pruner leaves it alone
+	rr = adminRequest(t, admin, http.MethodPost, "/v1/candidates/vol1/mount", MountRequest{Path: filepath.Join(t.TempDir(), "other")})
+	assert.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+	rr = adminRequest(t, admin, http.MethodDelete, "/v1/candidates/vol1", nil)
+	assert.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+
+	expired := *candidate
+	expired.InspectPath = inspectPath
+	expired.Time = time.Now().Add(-2 * expired.Lifespan)
+	n.deletedVolumes.remove("vol1")
+	n.deletedVolumes.queue("vol1", expired)
+	deleted, _ := n.deletedVolumes.prune(n.workdir, 0)
+	assert.Empty(t, deleted)
+
+	rr = adminRequest(t, admin, http.MethodDelete, "/v1/candidates/vol1/mount", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	mountPoints, err = mounter.List()
+	require.NoError(t, err)
+	assert.Empty(t, mountPoints)
+	assert.False(t, loop.attached(vol.Path))
+
+	deleted, _ = n.deletedVolumes.prune(n.workdir, 0)
+	assert.Equal(t, []string{"vol1"}, deleted)
+	assert.NoFileExists(t, vol.Path)
+}
+
+func TestImageMountFailure(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+
+	ns := &nodeServer{node: newTestNode(t), mounter: &failingMounter{FakeMounter: mount.NewFakeMounter(nil), fail: true}}
+	loop := withFakeLoopDevices(ns.node)
+	path := fullpath(ns.node.workdir, "pod1", "vol1")
+
+	_, err := ns.NodePublishVolume(context.Background(), imagePublishRequest(t.TempDir(), "vol1", "pod1", "ext4"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.False(t, loop.attached(path), "loop device should be detached when the image can't be mounted")
+}
+
+func TestImageOverExistingImage(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	withFakeLoopDevices(ns.node)
+	path := fullpath(ns.node.workdir, "pod1", "vol1")
+
+	// An image whose record was lost in a crash
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0750))
+	require.NoError(t, ioutil.WriteFile(path, []byte("filesystem"), 0600))
+
+	_, err := ns.NodePublishVolume(context.Background(), imagePublishRequest(t.TempDir(), "vol1", "pod1", "ext4"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "already exists")
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "filesystem", string(data), "the existing image should be neither truncated nor formatted")
+}
+
+func TestImageVolumeValidation(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	n := ns.node
+	withFakeLoopDevices(n)
+	targetDir := t.TempDir()
+
+	_, err := ns.NodePublishVolume(context.Background(), imagePublishRequest(targetDir, "vol1", "pod1", "btrfs"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req := imagePublishRequest(targetDir, "vol1", "pod1", "xfs")
+	delete(req.VolumeContext, sizeContext)
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Only image volumes can be mounted for inspection
+	path := fullpath(n.workdir, "pod1", "vol2")
+	require.NoError(t, os.MkdirAll(path, 0750))
+	n.deletedVolumes.queue("vol2", deletionCandidate{Time: time.Now(), Lifespan: time.Hour, Path: path})
+	admin := newAdminServer(n, ns.mounter).handler()
+	rr := adminRequest(t, admin, http.MethodPost, "/v1/candidates/vol2/mount", MountRequest{Path: t.TempDir()})
+	assert.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+	rr = adminRequest(t, admin, http.MethodPost, "/v1/candidates/vol2/mount", MountRequest{Path: "relative"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code, rr.Body.String())
+	rr = adminRequest(t, admin, http.MethodPost, "/v1/candidates/vol3/mount", MountRequest{Path: t.TempDir()})
+	assert.Equal(t, http.StatusNotFound, rr.Code, rr.Body.String())
+}
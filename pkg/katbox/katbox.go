@@ -15,22 +15,23 @@ limitations under the License.
 package katbox
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 )
 
 type katbox struct {
-	name          string
-	nodeID        string
-	version       string
-	endpoint      string
-	pruneInterval time.Duration
-	headroom      float64
+	// options holds the options the driver was created with, along with any reloaded since.
+	options     Options
+	optionsLock sync.Mutex
+
+	events *eventRecorder
 
 	idServer   *identityServer
 	nodeServer *nodeServer
@@ -45,67 +46,216 @@ type volume struct {
 	AccessType  accessType `json:"accessType"`
 	ParentVolID string     `json:"parentVolID,omitempty"`
 	Ephemeral   bool       `json:"ephemeral"`
+	Inodes      int64      `json:"inodes,omitempty"`
+	ProjectID   uint32     `json:"projectID,omitempty"`
+
+	// Retention overrides the node's afterlife span for this volume when set. An explicit zero keeps
+	// the volume only until the next prune round, so it is told apart from an absent retention.
+	Retention *time.Duration `json:"retention,omitempty"`
+
+	// Pool is the storage pool the volume was created in. Records written before pools existed leave it empty.
+	Pool string `json:"pool,omitempty"`
+
+	// FsType is the filesystem image volumes are formatted with.
+	FsType string `json:"fsType,omitempty"`
+
+	// Template is the name of the template the volume was seeded from.
+	Template string `json:"template,omitempty"`
+
+	// Retained is the ID of the retained volume shown read only by this volume, which owns nothing on disk.
+	Retained string `json:"retained,omitempty"`
+
+	// TargetPath is where the kubelet asked for the volume to be mounted.
+	TargetPath string `json:"targetPath,omitempty"`
+
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+
+	// OverLimit is set when a volume without a project quota is found to be using more than its size.
+	// It is persisted so that the volume keeps being reported as abnormal across restarts.
+	OverLimit bool `json:"overLimit,omitempty"`
 }
 
 var (
 	vendorVersion = "dev"
 )
 
-func NewKatboxDriver(
-	driverName, nodeID, endpoint, workdir string,
-	maxVolumesPerNode int64,
-	afterlifeSpan, deleteInterval time.Duration,
-	headroom float64,
-	version string) (*katbox, error) {
-	if driverName == "" {
-		return nil, errors.New("no driver name provided")
-	}
+func (vol volume) pod() podRef {
+	return podRef{UID: vol.PodUUID, Name: vol.PodName, Namespace: vol.PodNamespace}
+}
 
-	if nodeID == "" {
-		return nil, errors.New("no node id provided")
+func NewKatboxDriver(opts Options) (*katbox, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
 
-	if endpoint == "" {
-		return nil, errors.New("no driver endpoint provided")
-	}
-	if version != "" {
-		vendorVersion = version
+	if opts.Version != "" {
+		vendorVersion = opts.Version
 	}
 
-	if err := os.MkdirAll(workdir, 0750); err != nil {
+	if err := os.MkdirAll(opts.Workdir, 0750); err != nil {
 		return nil, fmt.Errorf("failed to create working directory: %v", err)
 	}
 
-	glog.Infof("Driver: %v ", driverName)
+	glog.Infof("Driver: %v ", opts.DriverName)
 	glog.Infof("Version: %s", vendorVersion)
+	glog.Infof("Eviction policy: %s", opts.EvictionPolicy)
+	glog.Infof("Pressure curve: %s, floor %v above critical headroom %v", opts.PressureCurve, opts.PressureFloor, opts.CriticalHeadroom)
+
+	policy, err := newEvictionPolicy(opts.EvictionPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	curve, err := newPressureCurve(opts.PressureCurve)
+	if err != nil {
+		return nil, err
+	}
+
+	if (opts.WatchPods || opts.EmitEvents) && opts.KubeClient == nil {
+		opts.KubeClient, err = NewKubeClient(opts.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n, nodeErr := NewNode(
+		opts.NodeID,
+		opts.Workdir,
+		opts.Pools,
+		opts.MaxVolumesPerNode,
+		opts.AfterlifeSpan,
+		opts.MinAfterlifeSpan,
+		opts.MaxAfterlifeSpan,
+		opts.DeleteTimeout,
+		opts.MaxDeleteAttempts,
+		policy,
+	)
+	if nodeErr != nil {
+		glog.Errorf("node failed to initialize: %s", nodeErr)
+	} else {
+		n.templatesDir = opts.TemplatesDir
+		n.volumeMode, _ = parseVolumeMode(opts.VolumeMode)
+		n.deletedVolumes.settings.set(opts.PruneInterval, opts.Headroom, opts.InodeHeadroom)
+		n.deletedVolumes.curve = curve
+		n.deletedVolumes.floor = pressureFloor{floor: opts.PressureFloor, criticalHeadroom: opts.CriticalHeadroom}
+	}
+
+	var events *eventRecorder
+	if opts.EmitEvents && n != nil {
+		events = newEventRecorder(opts.KubeClient, opts.NodeID, opts.DriverName, float32(opts.EventQPS), opts.EventBurst)
+		n.events = events
+		n.deletedVolumes.events = events
+	}
+
+	idServer := NewIdentityServer(opts.DriverName, opts.Version, n, opts.PruneStallMultiple)
+	idServer.initErr = nodeErr
 
 	return &katbox{
-		name:          driverName,
-		version:       vendorVersion,
-		nodeID:        nodeID,
-		endpoint:      endpoint,
-		pruneInterval: deleteInterval,
-		headroom:      headroom,
-		idServer:      NewIdentityServer(driverName, version),
-		nodeServer:    &nodeServer{node: NewNode(nodeID, workdir, maxVolumesPerNode, afterlifeSpan)},
+		options:  opts,
+		events:   events,
+		idServer: idServer,
+		nodeServer: &nodeServer{
+			node:               n,
+			mounter:            mount.New(""),
+			exec:               utilexec.New(),
+			pruneStallMultiple: opts.PruneStallMultiple,
+		},
 	}, nil
 }
 
+// Reload applies the options which are safe to change while the driver runs: the prune interval and the headrooms.
+// Changes to any other option are logged and only take effect once the driver is restarted.
+func (k *katbox) Reload(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	k.optionsLock.Lock()
+	defer k.optionsLock.Unlock()
+
+	// Compare everything but the reloadable options and the client, which is never read from configuration
+	unchanged := opts
+	unchanged.PruneInterval = k.options.PruneInterval
+	unchanged.Headroom = k.options.Headroom
+	unchanged.InodeHeadroom = k.options.InodeHeadroom
+	unchanged.KubeClient = k.options.KubeClient
+	if !reflect.DeepEqual(unchanged, k.options) {
+		glog.Warning("only the prune interval and headrooms can be changed without restarting the plugin, other changes are ignored")
+	}
+
+	glog.Infof("reloaded configuration: prune interval %s, headroom %v, inode headroom %v",
+		opts.PruneInterval, opts.Headroom, opts.InodeHeadroom)
+	k.options.PruneInterval = opts.PruneInterval
+	k.options.Headroom = opts.Headroom
+	k.options.InodeHeadroom = opts.InodeHeadroom
+	if k.nodeServer != nil && k.nodeServer.node != nil {
+		k.nodeServer.node.deletedVolumes.settings.set(opts.PruneInterval, opts.Headroom, opts.InodeHeadroom)
+	}
+	return nil
+}
+
 func (k *katbox) Run() {
-	if k.idServer == nil || k.nodeServer == nil || k.nodeServer.node == nil {
-		glog.V(1).Infof("unable to create server")
+	if k.idServer == nil || k.nodeServer == nil {
+		glog.Error("unable to create server")
+		return
+	}
+
+	// Keep answering probes so the reason the node failed to initialize shows up in the liveness probe
+	if k.nodeServer.node == nil {
+		glog.Error("node failed to initialize, only serving the identity server")
+		s := NewNonBlockingGRPCServer()
+		s.Start(k.options.Endpoint, k.idServer, nil)
+		s.Wait()
 		return
 	}
 
+	// Catch up with whatever happened while the plugin was down before serving requests
+	k.nodeServer.node.reconcile(procMounts)
+	k.nodeServer.node.reattachLoopDevices()
+
+	// Catch pods that went away without their volumes being unpublished
+	var watcher *podWatcher
+	if k.options.WatchPods {
+		watcher = newPodWatcher(k.options.KubeClient, k.nodeServer.node, k.options.NodeID)
+		if k.events != nil {
+			k.events.podExists = watcher.podExists
+		}
+	}
+
+	if k.options.MetricsAddress != "" {
+		go serveMetrics(k.options.MetricsAddress, newMetricsRegistry(k.nodeServer.node))
+	}
+
+	if k.options.AdminEndpoint != "" {
+		go newAdminServer(k.nodeServer.node, k.nodeServer.mounter).serve(k.options.AdminEndpoint)
+	}
+
 	// Create GRPC servers
 	s := NewNonBlockingGRPCServer()
-	s.Start(k.endpoint, k.idServer, k.nodeServer)
+	s.Start(k.options.Endpoint, k.idServer, k.nodeServer)
 
 	// Start pruner as a go routine
 	endPrune := make(chan struct{})
 	wg := sync.WaitGroup{}
 	wg.Add(1)
-	go k.nodeServer.node.deletedVolumes.periodicCleanup(endPrune, k.pruneInterval, &wg, k.headroom, k.nodeServer.node.workdir)
+	go k.nodeServer.node.deletedVolumes.periodicCleanup(endPrune, &wg, k.nodeServer.node.workdir)
+
+	// Volume sizes have to be checked by hand when the filesystem can't enforce them for us
+	if k.nodeServer.node.softLimitsNeeded() {
+		wg.Add(1)
+		go k.nodeServer.node.periodicSoftLimitCheck(endPrune, k.options.SoftLimitInterval, &wg)
+	}
+
+	if watcher != nil {
+		wg.Add(1)
+		go watcher.run(endPrune, k.options.PodSweepInterval, &wg)
+	}
+
+	if k.options.ReconcileInterval > 0 {
+		wg.Add(1)
+		go k.nodeServer.node.periodicReconcile(endPrune, k.options.ReconcileInterval, &wg)
+	}
 
 	// Wait for identity and node server to shut down
 	s.Wait()
@@ -0,0 +1,201 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	bolt "go.etcd.io/bbolt"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "katbox"
+
+var (
+	pressureFactorGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pressure_factor",
+		Help:      "Disk pressure factor applied to the afterlife of deletion candidates of a storage pool during the last prune round.",
+	}, []string{"pool"})
+
+	resourcePressureFactorGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "resource_pressure_factor",
+		Help:      "Pressure factor derived from the free bytes or inodes of a storage pool during the last prune round, the lowest of which is applied.",
+	}, []string{"pool", "resource"})
+
+	pruneDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "prune_duration_seconds",
+		Help:      "Time taken by a prune round.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	pruneReclaimedBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "prune_reclaimed_bytes",
+		Help:      "Bytes freed from the working directory by a prune round.",
+		Buckets:   prometheus.ExponentialBuckets(float64(mib), 4, 10),
+	})
+
+	pruneTargetBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prune_target_bytes",
+		Help:      "Bytes a storage pool needed to free to get back above its headroom at the start of the last prune round.",
+	}, []string{"pool"})
+
+	pruneLastReclaimedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prune_pool_reclaimed_bytes",
+		Help:      "Bytes freed from a storage pool by the last prune round.",
+	}, []string{"pool"})
+
+	pruneTargetInodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prune_target_inodes",
+		Help:      "Inodes a storage pool needed to free to get back above the inode headroom at the start of the last prune round.",
+	}, []string{"pool"})
+
+	pruneLastReclaimedInodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "prune_pool_reclaimed_inodes",
+		Help:      "Inodes freed from a storage pool by the last prune round.",
+	}, []string{"pool"})
+
+	templateCopyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "template_copy_duration_seconds",
+		Help:      "Time taken to seed a new volume from a template, partitioned by template.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"template"})
+
+	reconcileCorrections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconcile_corrections_total",
+		Help:      "Number of records, directories and queue entries corrected by reconciliation, partitioned by kind.",
+	}, []string{"kind"})
+
+	grpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of CSI gRPC requests handled, partitioned by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Latency of CSI gRPC requests, partitioned by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+// newMetricsRegistry creates a registry holding katbox's metrics along with gauges
+// which are read straight from the node's state whenever they are scraped.
+func newMetricsRegistry(n *node) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		pressureFactorGauge,
+		resourcePressureFactorGauge,
+		pruneDuration,
+		pruneReclaimedBytes,
+		pruneTargetBytes,
+		pruneLastReclaimedBytes,
+		pruneTargetInodes,
+		pruneLastReclaimedInodes,
+		templateCopyDuration,
+		reconcileCorrections,
+		grpcRequests,
+		grpcDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "volumes",
+			Help:      "Number of live volumes published on this node.",
+		}, func() float64 {
+			n.volumesLock.RLock()
+			defer n.volumesLock.RUnlock()
+			return float64(len(n.volumes))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "deletion_queue_length",
+			Help:      "Number of volumes waiting to be deleted.",
+		}, func() float64 {
+			n.deletedVolumes.lock.RLock()
+			defer n.deletedVolumes.lock.RUnlock()
+			return float64(len(n.deletedVolumes.candidates))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "stuck_deletions",
+			Help:      "Number of volumes the pruner gave up deleting after repeated failures.",
+		}, func() float64 {
+			return float64(n.deletedVolumes.stuckCount())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pruner_last_round_timestamp_seconds",
+			Help:      "Unix time at which the pruner last finished a round.",
+		}, func() float64 {
+			return float64(n.deletedVolumes.lastRoundTime().UnixNano()) / float64(time.Second)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "bolt_db_size_bytes",
+			Help:      "Size of the persistent storage holding volume records.",
+		}, func() float64 {
+			var size int64
+			err := n.storage.View(func(tx *bolt.Tx) error {
+				size = tx.Size()
+				return nil
+			})
+			if err != nil {
+				glog.V(4).Infof("unable to determine size of persistent storage: %s", err)
+			}
+			return float64(size)
+		}),
+	)
+	return registry
+}
+
+// serveMetrics exposes the registry for Prometheus to scrape. It blocks until the server stops.
+func serveMetrics(address string, registry *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	glog.Infof("Serving metrics on address: %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		glog.Errorf("metrics server stopped: %s", err)
+	}
+}
+
+func metricsGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
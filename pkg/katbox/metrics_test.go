@@ -0,0 +1,80 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func grpcCalls(t *testing.T, method string) uint64 {
+	var m dto.Metric
+	require.NoError(t, grpcDuration.WithLabelValues(method).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMetricsGRPC(t *testing.T) {
+	const method = "/csi.v1.Node/NodeGetVolumeStats"
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+	okBefore := testutil.ToFloat64(grpcRequests.WithLabelValues(method, codes.OK.String()))
+	notFoundBefore := testutil.ToFloat64(grpcRequests.WithLabelValues(method, codes.NotFound.String()))
+	callsBefore := grpcCalls(t, method)
+
+	resp, err := metricsGRPC(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "response", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "response", resp)
+
+	_, err = metricsGRPC(context.Background(), "request", info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "volume not found")
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "errors should be passed through")
+
+	assert.Equal(t, okBefore+1, testutil.ToFloat64(grpcRequests.WithLabelValues(method, codes.OK.String())))
+	assert.Equal(t, notFoundBefore+1, testutil.ToFloat64(grpcRequests.WithLabelValues(method, codes.NotFound.String())))
+	assert.Equal(t, callsBefore+2, grpcCalls(t, method))
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	n := newTestNode(t)
+	n.setVolume(volume{ID: "vol1"})
+	n.deletedVolumes.candidates["vol2"] = &deletionCandidate{Stuck: true}
+
+	families, err := newMetricsRegistry(n).Gather()
+	require.NoError(t, err)
+
+	gauges := make(map[string]float64)
+	for _, family := range families {
+		if family.GetType() == dto.MetricType_GAUGE && len(family.GetMetric()) == 1 {
+			gauges[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, 1.0, gauges["katbox_volumes"])
+	assert.Equal(t, 1.0, gauges["katbox_deletion_queue_length"])
+	assert.Equal(t, 1.0, gauges["katbox_stuck_deletions"])
+	assert.Greater(t, gauges["katbox_bolt_db_size_bytes"], 0.0)
+}
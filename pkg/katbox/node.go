@@ -17,15 +17,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
 	bolt "go.etcd.io/bbolt"
+	v1 "k8s.io/api/core/v1"
 
+	"k8s.io/kubernetes/pkg/volume/util/fs"
 	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
 	utilexec "k8s.io/utils/exec"
 )
@@ -33,34 +37,80 @@ import (
 type node struct {
 	id             string
 	volumes        map[string]volume
+	volumesLock    sync.RWMutex
 	deletedVolumes deletedVolumes
 	workdir        string
+	pools          map[string]*storagePool
+	templatesDir   string
+	volumeMode     os.FileMode
 	afterLifespan  time.Duration
+	minLifespan    time.Duration
+	maxLifespan    time.Duration
 	maxVolumes     int64
 	storage        *bolt.DB
+	quota          *projectQuota
+	events         *eventRecorder
+
+	// loop attaches the backing files of block and image volumes to loop devices.
+	loop volumepathhandler.BlockVolumePathHandler
+
+	// locks serializes operations on the same volume, which the kubelet may issue concurrently.
+	locks volumeLocks
 }
 
-func NewNode(id, workdir string, maxVolumes int64, afterLifespan time.Duration) *node {
+func NewNode(
+	id, workdir string,
+	poolOptions []PoolOptions,
+	maxVolumes int64,
+	afterLifespan, minLifespan, maxLifespan, deleteTimeout time.Duration,
+	maxDeleteAttempts int,
+	policy evictionPolicy) (*node, error) {
 	db, err := initializePermanentStorage(
 		path.Join(workdir, "deletedVolumes.db"),
 		deletedVolumesBucketName,
-		volumesBucketName)
+		volumesBucketName,
+		podsBucketName)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to open persistent storage: %w", err)
 	}
 
 	candidates, err := loadDeletedVolumesFromPersistent(db, deletedVolumesBucketName)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to load volumes queued for deletion: %w", err)
+	}
+
+	if err := reindexPods(db, candidates); err != nil {
+		return nil, fmt.Errorf("unable to index volumes queued for deletion by pod: %w", err)
 	}
 
 	volumes, err := loadVolumesFromPersistent(db, volumesBucketName)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to load volume records: %w", err)
 	}
 
 	glog.V(4).Infof("loaded %d volume records into memory", len(volumes))
 
+	quota := newProjectQuota(workdir)
+	pools, err := newStoragePools(poolOptions, quota, afterLifespan)
+	if err != nil {
+		return nil, err
+	}
+
+	// Project IDs stay assigned to a directory until the pruner removes it from disk.
+	poolQuota := func(name string) *projectQuota {
+		if p, ok := pools[name]; ok {
+			return p.quota
+		}
+		return quota
+	}
+	for _, vol := range volumes {
+		poolQuota(vol.Pool).reserve(vol.ProjectID)
+	}
+	for _, candidate := range candidates {
+		poolQuota(candidate.Pool).reserve(candidate.ProjectID)
+	}
+
+	loop := volumepathhandler.VolumePathHandler{}
 	return &node{
 		id:      id,
 		volumes: volumes,
@@ -68,12 +118,28 @@ func NewNode(id, workdir string, maxVolumes int64, afterLifespan time.Duration)
 			candidates: candidates,
 			lock:       sync.RWMutex{},
 			storage:    db,
+			quota:      quota,
+			pools:      pools,
+			loop:       loop,
+			policy:     policy,
+
+			deleteTimeout:     deleteTimeout,
+			maxDeleteAttempts: maxDeleteAttempts,
+			inFlight:          make(map[string]chan deletionResult),
+			lastRound:         time.Now().UnixNano(),
+			settings:          pruneSettings{reloaded: make(chan struct{}, 1)},
 		},
 		workdir:       workdir,
+		pools:         pools,
+		volumeMode:    defaultVolumeMode,
 		afterLifespan: afterLifespan,
+		minLifespan:   minLifespan,
+		maxLifespan:   maxLifespan,
 		maxVolumes:    maxVolumes,
 		storage:       db,
-	}
+		quota:         quota,
+		loop:          loop,
+	}, nil
 }
 
 func initializePermanentStorage(dbFilename string, bucketNames ...string) (*bolt.DB, error) {
@@ -175,29 +241,42 @@ func loadVolumesFromPersistent(db *bolt.DB, bucketName string) (map[string]volum
 	return volumes, nil
 }
 
-// createEphemeralVolume create the directory for the katbox volume.
-// It returns the volume path or err if one occurs.
-func (n *node) createEphemeralVolume(volID, podUUID, name string, cap int64, volAccessType accessType) (*volume, error) {
-	fullPath := fullpath(n.workdir, podUUID, volID)
+// createEphemeralVolume create the directory for the katbox volume in the pool.
+// The spec holds the volume's identity along with what was requested through the volume attributes.
+// A size lower than maxStorageCapacity or a non zero inode count limits how much the volume may consume.
+// It returns the volume or err if one occurs.
+func (n *node) createEphemeralVolume(spec volume, pool *storagePool, owner volumeOwner) (*volume, error) {
+	// Publishing may be retried by the kubelet, in which case the volume we already created is reused.
+	if vol, err := n.volumeByID(spec.ID); err == nil {
+		return &vol, nil
+	}
 
-	switch volAccessType {
+	volID, cap := spec.ID, spec.Size
+	fullPath := fullpath(pool.workdir, spec.PodUUID, volID)
+	var projectID uint32
+
+	switch spec.AccessType {
 	case mountAccess:
-		err := os.MkdirAll(fullPath, 0777)
+		var err error
+		projectID, err = n.createVolumeDirectory(spec, pool, owner, fullPath)
 		if err != nil {
 			return nil, err
 		}
 	case blockAccess:
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0750); err != nil {
+			return nil, err
+		}
+
 		executor := utilexec.New()
-		size := fmt.Sprintf("%dM", cap/mib)
-		// Create a block file.
+		// Create a block file. Its size is rounded up to a whole number of mebibytes so the loop device spans all of it.
+		size := fmt.Sprintf("%dM", roundUpToMiB(cap)/mib)
 		out, err := executor.Command("fallocate", "-l", size, fullPath).CombinedOutput()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create block device: %v, %v", err, string(out))
 		}
 
 		// Associate block file with the loop device.
-		volPathHandler := volumepathhandler.VolumePathHandler{}
-		_, err = volPathHandler.AttachFileDevice(fullPath)
+		_, err = n.loop.AttachFileDevice(fullPath)
 		if err != nil {
 			// Remove the block file because it'll no longer be used again.
 			if err2 := os.Remove(fullPath); err2 != nil {
@@ -205,26 +284,351 @@ func (n *node) createEphemeralVolume(volID, podUUID, name string, cap int64, vol
 			}
 			return nil, fmt.Errorf("failed to attach device %v: %v", fullPath, err)
 		}
+	case imageAccess:
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0750); err != nil {
+			return nil, err
+		}
+
+		if err := createImage(fullPath, cap, spec.FsType); err != nil {
+			return nil, err
+		}
 	default:
-		return nil, fmt.Errorf("unsupported access type %v", volAccessType)
+		return nil, fmt.Errorf("unsupported access type %v", spec.AccessType)
 	}
 
-	vol := volume{
-		Name:       name,
-		ID:         volID,
-		PodUUID:    podUUID,
-		Size:       cap,
-		Path:       fullPath,
-		AccessType: volAccessType,
-		Ephemeral:  true,
-	}
-	n.volumes[volID] = vol
+	vol := spec
+	vol.Pool = pool.name
+	vol.Path = fullPath
+	vol.Ephemeral = true
+	vol.ProjectID = projectID
+	n.setVolume(vol)
 	return &vol, nil
 }
 
+// createVolumeDirectory creates the directory of a volume with its quota, template and ownership, returning the
+// project ID assigned to it. The directory is prepared under a staging name and renamed once complete, so that the
+// pod never sees it half seeded or with the wrong permissions.
+func (n *node) createVolumeDirectory(spec volume, pool *storagePool, owner volumeOwner, fullPath string) (uint32, error) {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0750); err != nil {
+		return 0, err
+	}
+
+	// A directory whose record was lost may hold data seeded or written by its pod, it is neither reused
+	// nor replaced. Reconciliation queues it for deletion like any other orphan.
+	if _, err := os.Lstat(fullPath); err == nil {
+		return 0, fmt.Errorf("volume directory %s already exists without a record", fullPath)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	// A staging directory left behind by a crash is started over
+	staging := stagingPath(fullPath)
+	if err := os.RemoveAll(staging); err != nil {
+		return 0, err
+	}
+	if err := os.Mkdir(staging, 0700); err != nil {
+		return 0, err
+	}
+
+	var projectID uint32
+	err := func() error {
+		var err error
+		if (spec.Size < maxStorageCapacity || spec.Inodes > 0) && pool.quota.enabled() {
+			projectID, err = pool.quota.assign(staging, spec.Size, spec.Inodes)
+			if err != nil {
+				return fmt.Errorf("failed to limit volume size: %w", err)
+			}
+		}
+
+		// Seeding happens once the quota is in place so that the template counts towards the volume's size
+		if spec.Template != "" {
+			if err := n.seedVolume(staging, spec.Template); err != nil {
+				return err
+			}
+		}
+
+		if err := owner.apply(staging); err != nil {
+			return err
+		}
+		return os.Rename(staging, fullPath)
+	}()
+
+	if err != nil {
+		if err2 := os.RemoveAll(staging); err2 != nil {
+			glog.Errorf("failed to cleanup directory %s: %v", staging, err2)
+		} else if err2 := pool.quota.release(projectID); err2 != nil {
+			glog.Errorf("failed to release quota of %s: %v", fullPath, err2)
+		}
+		return 0, err
+	}
+
+	return projectID, nil
+}
+
+// checkHealth returns an error describing why the node is unable to serve requests.
+// The working directory of every pool must be writable, the persistent storage readable and the pruner
+// must have finished a round within pruneStallTimeout.
+func (n *node) checkHealth(pruneStallTimeout time.Duration) error {
+	for _, pool := range n.listPools() {
+		if err := probeWorkdir(pool.workdir); err != nil {
+			return err
+		}
+	}
+
+	err := n.storage.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{volumesBucketName, deletedVolumesBucketName} {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("bucket %s does not exist", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("persistent storage is unreadable: %w", err)
+	}
+
+	if pruneStallTimeout > 0 {
+		if since := time.Since(n.deletedVolumes.lastRoundTime()); since > pruneStallTimeout {
+			return fmt.Errorf("pruner has not finished a round in %s", since.Round(time.Second))
+		}
+	}
+
+	return nil
+}
+
+// probeWorkdir returns an error unless a file can be written to the working directory.
+func probeWorkdir(workdir string) error {
+	probe, err := ioutil.TempFile(workdir, ".probe-")
+	if err != nil {
+		return fmt.Errorf("working directory %s is not writable: %w", workdir, err)
+	}
+	defer os.Remove(probe.Name())
+
+	// Syncing makes sure a full disk is surfaced instead of being hidden by the page cache
+	_, err = probe.Write([]byte{0})
+	if err == nil {
+		err = probe.Sync()
+	}
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write to working directory %s: %w", workdir, err)
+	}
+	return nil
+}
+
+// lifespan returns how long the volume should be kept around after being unpublished.
+// Retention requested by the pod is kept within the node's bounds in case these changed since publishing.
+func (n *node) lifespan(vol volume) time.Duration {
+	if vol.Retention == nil {
+		return n.poolOf(vol.Pool).afterLifespan
+	}
+	return clampDuration(*vol.Retention, n.minLifespan, n.maxLifespan)
+}
+
 func (n *node) volumeByID(id string) (volume, error) {
+	n.volumesLock.RLock()
+	defer n.volumesLock.RUnlock()
+
 	if vol, ok := n.volumes[id]; ok {
 		return vol, nil
 	}
 	return volume{}, fmt.Errorf("volume id %s does not exist in the volumes list", id)
 }
+
+func (n *node) setVolume(vol volume) {
+	n.volumesLock.Lock()
+	defer n.volumesLock.Unlock()
+
+	n.volumes[vol.ID] = vol
+}
+
+// saveVolume persists the volume record, replacing any previous one.
+func (n *node) saveVolume(vol volume) error {
+	return n.storage.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(volumesBucketName))
+		if bucket == nil {
+			return fmt.Errorf("bucket %s does not exist", volumesBucketName)
+		}
+
+		marshaledVol, err := json.Marshal(vol)
+		if err != nil {
+			return fmt.Errorf("unable to serialize volume: %w", err)
+		}
+
+		err = bucket.Put([]byte(vol.ID), marshaledVol)
+		if err != nil {
+			return fmt.Errorf("unable to insert volume %s into database: %w", vol.ID, err)
+		}
+
+		return nil
+	})
+}
+
+func (n *node) removeVolume(id string) {
+	n.volumesLock.Lock()
+	defer n.volumesLock.Unlock()
+
+	delete(n.volumes, id)
+}
+
+// listVolumes returns a copy of the live volumes which is safe to use while CSI calls modify them.
+func (n *node) listVolumes() []volume {
+	n.volumesLock.RLock()
+	defer n.volumesLock.RUnlock()
+
+	volumes := make([]volume, 0, len(n.volumes))
+	for _, vol := range n.volumes {
+		volumes = append(volumes, vol)
+	}
+	return volumes
+}
+
+// reattachLoopDevices attaches the backing file of every live block or image volume to a loop device, as
+// loop devices don't survive a reboot of the node. Files that are still attached are left alone.
+func (n *node) reattachLoopDevices() {
+	for _, vol := range n.listVolumes() {
+		if !vol.AccessType.usesLoopDevice() || !n.locks.tryAcquire(vol.ID) {
+			continue
+		}
+
+		if device, err := n.loop.AttachFileDevice(vol.Path); err != nil {
+			glog.Errorf("unable to attach %s volume %s at %s to a loop device: %s", vol.AccessType, vol.ID, vol.Path, err)
+		} else {
+			glog.V(4).Infof("%s volume %s at %s is attached to %s", vol.AccessType, vol.ID, vol.Path, device)
+		}
+
+		n.locks.release(vol.ID)
+	}
+}
+
+// queueForDeletion hands an unpublished volume over to the pruner and forgets it as a live volume.
+func (n *node) queueForDeletion(id string, vol volume) {
+	// A volume showing a retained volume only hands it back to the pruner
+	if vol.Retained != "" {
+		if err := n.detachRetained(vol.Retained, id); err != nil {
+			glog.Error(err)
+		}
+		n.forgetVolume(id)
+		return
+	}
+
+	// Queue folder that was previously mounted on to pod for deletion. Note that this is different
+	// than the point where the folder was bind mounted to.
+	candidate := deletionCandidate{
+		Time:         time.Now(),
+		Lifespan:     n.lifespan(vol),
+		Path:         fullpath(n.poolOf(vol.Pool).workdir, vol.PodUUID, id),
+		PodUUID:      vol.PodUUID,
+		ProjectID:    vol.ProjectID,
+		Pool:         vol.Pool,
+		AccessType:   vol.AccessType,
+		FsType:       vol.FsType,
+		PodName:      vol.PodName,
+		PodNamespace: vol.PodNamespace,
+	}
+	if n.deletedVolumes.queue(id, candidate) {
+		n.events.podEvent(vol.pod(), v1.EventTypeNormal, volumeQueued,
+			"Volume %s queued for deletion, it is retained until %s unless disk pressure evicts it earlier",
+			id, evictionTime(&candidate, 1.0).Format(time.RFC3339))
+	}
+
+	n.forgetVolume(id)
+}
+
+// forgetVolume deletes the record of a live volume.
+func (n *node) forgetVolume(id string) {
+	err := n.storage.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(volumesBucketName))
+
+		err := bucket.Delete([]byte(id))
+		if err != nil {
+			return fmt.Errorf("unable to delete %s from permanent storage: %s", id, err)
+		}
+		return nil
+	})
+
+	if err != nil {
+		glog.Error(err)
+	}
+
+	n.removeVolume(id)
+}
+
+// softLimitsNeeded reports whether any pool lacks project quota support, in which case volume sizes
+// have to be checked by hand.
+func (n *node) softLimitsNeeded() bool {
+	for _, pool := range n.listPools() {
+		if !pool.quota.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// periodicSoftLimitCheck enforces volume sizes on filesystems that lack project quota support by
+// periodically measuring the volumes which were given a size.
+func (n *node) periodicSoftLimitCheck(done <-chan struct{}, interval time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n.checkSoftLimits()
+		}
+	}
+}
+
+// checkSoftLimits flags every mount volume without a project quota which has outgrown its size or inode limit.
+// Viewers of retained volumes own nothing and are left out.
+func (n *node) checkSoftLimits() {
+	for _, vol := range n.listVolumes() {
+		id := vol.ID
+		if vol.AccessType != mountAccess || vol.ProjectID != 0 || vol.Retained != "" ||
+			(vol.Size >= maxStorageCapacity && vol.Inodes == 0) {
+			continue
+		}
+
+		usage, err := fs.DiskUsage(vol.Path)
+		if err != nil {
+			glog.V(4).Infof("unable to determine disk usage of volume %s: %s", id, err)
+			continue
+		}
+
+		overLimit := usage.Bytes > vol.Size || (vol.Inodes > 0 && usage.Inodes > vol.Inodes)
+		if overLimit == vol.OverLimit {
+			continue
+		}
+
+		// The volume may have been unpublished while its usage was being measured, holding its lock
+		// keeps the record from being written back once it is gone. Busy volumes are checked next time.
+		if !n.locks.tryAcquire(id) {
+			continue
+		}
+		if current, err := n.volumeByID(id); err == nil {
+			current.OverLimit = overLimit
+			n.setVolume(current)
+			if err := n.saveVolume(current); err != nil {
+				glog.Errorf("Unable to persist volume %s: %s", id, err)
+			}
+
+			if overLimit {
+				glog.Warningf(
+					"volume %s of pod %s is using %d bytes and %d inodes, exceeding its limit of %d bytes and %d inodes",
+					id, vol.PodUUID, usage.Bytes, usage.Inodes, vol.Size, vol.Inodes)
+				n.events.podEvent(vol.pod(), v1.EventTypeWarning, volumeOverLimit,
+					"Volume %s is using %d bytes and %d inodes, exceeding its limit of %d bytes and %d inodes",
+					id, usage.Bytes, usage.Inodes, vol.Size, vol.Inodes)
+			} else {
+				glog.Infof("volume %s of pod %s is back within its limit", id, vol.PodUUID)
+			}
+		}
+		n.locks.release(id)
+	}
+}
@@ -19,8 +19,8 @@ limitations under the License.
 package katbox
 
 import (
-	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"strings"
 	"time"
@@ -30,22 +30,30 @@ import (
 
 	"golang.org/x/net/context"
 
-	bolt "go.etcd.io/bbolt"
+	v1 "k8s.io/api/core/v1"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"k8s.io/kubernetes/pkg/volume/util/volumepathhandler"
+	"k8s.io/kubernetes/pkg/volume/util/fs"
 	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
 )
 
 const TopologyKeyNode = "topology.katbox.csi/node"
 
 type nodeServer struct {
-	node *node
+	node    *node
+	mounter mount.Interface
+
+	// exec runs the tools growing image volumes.
+	exec utilexec.Interface
+
+	// pruneStallMultiple is the number of prune intervals after which volume stats report the pruner as stalled.
+	pruneStallMultiple int
 }
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (resp *csi.NodePublishVolumeResponse, err error) {
 
 	// Check arguments
 	if req.GetVolumeCapability() == nil {
@@ -67,15 +75,105 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "this CSI driver only supports ephemeral volumes")
 	}
 
+	if !ns.node.locks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer ns.node.locks.release(req.GetVolumeId())
+
+	pod := podRef{
+		UID:       podUUID,
+		Name:      req.GetVolumeContext()[podNameContext],
+		Namespace: req.GetVolumeContext()[podNamespaceContext],
+	}
+	defer func() {
+		if err != nil {
+			ns.node.events.podEvent(pod, v1.EventTypeWarning, volumePublishFailed,
+				"Unable to publish volume %s: %s", req.GetVolumeId(), status.Convert(err).Message())
+		}
+	}()
+
 	if req.GetVolumeCapability().GetBlock() != nil &&
 		req.GetVolumeCapability().GetMount() != nil {
 		return nil, status.Error(codes.InvalidArgument, "volume cannot be of both block and mount access type")
 	}
 
+	if ref, ok := req.GetVolumeContext()[attachRetainedContext]; ok {
+		return ns.publishRetained(req, pod, ref)
+	}
+
+	size, inodes, err := volumeLimits(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volAccessType := mountAccess
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	if req.GetVolumeCapability().GetBlock() != nil {
+		volAccessType = blockAccess
+	} else if fsType != "" {
+		// Asking for a filesystem gets the volume an image of its own rather than a directory of the pool's
+		if !imageFsTypes[fsType] {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported fsType %q, must be ext4 or xfs", fsType)
+		}
+		volAccessType = imageAccess
+	}
+
+	if volAccessType.usesLoopDevice() {
+		// The backing file is sized up front, so it has to be given a size
+		if _, ok := req.GetVolumeContext()[sizeContext]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "%s volumes require a %s attribute", volAccessType, sizeContext)
+		}
+		if inodes > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s attribute is not supported by %s volumes", inodesContext, volAccessType)
+		}
+	}
+
+	retention, err := volumeRetention(req.GetVolumeContext(), ns.node.minLifespan, ns.node.maxLifespan)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	template, ok := req.GetVolumeContext()[templateContext]
+	if ok {
+		if volAccessType != mountAccess {
+			return nil, status.Errorf(codes.InvalidArgument, "%s attribute is not supported by %s volumes", templateContext, volAccessType)
+		}
+		if _, _, err := ns.node.findTemplate(template); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	pool, ok := ns.node.pool(req.GetVolumeContext()[poolContext])
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown %s attribute %q", poolContext, req.GetVolumeContext()[poolContext])
+	}
+
+	owner, err := volumeOwnership(req.GetVolumeContext(), req.GetVolumeCapability().GetMount().GetVolumeMountGroup(), ns.node.volumeMode)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if volAccessType == blockAccess {
+		for _, attribute := range []string{uidContext, gidContext, modeContext} {
+			if _, ok := req.GetVolumeContext()[attribute]; ok {
+				return nil, status.Errorf(codes.InvalidArgument, "%s attribute is not supported by %s volumes", attribute, volAccessType)
+			}
+		}
+	}
+
 	volID := req.GetVolumeId()
 	volName := fmt.Sprintf("ephemeral-%s", volID)
-	ephVol, err := ns.node.createEphemeralVolume(req.GetVolumeId(), podUUID, volName, maxStorageCapacity, mountAccess)
-	if err != nil && !os.IsExist(err) {
+	ephVol, err := ns.node.createEphemeralVolume(volume{
+		Name:       volName,
+		ID:         volID,
+		PodUUID:    podUUID,
+		Size:       size,
+		Inodes:     inodes,
+		Retention:  retention,
+		AccessType: volAccessType,
+		FsType:     fsType,
+		Template:   template,
+	}, pool, owner)
+	if err != nil {
 		glog.Error("failed to create ephemeral volume: ", err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -91,15 +189,13 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, status.Error(codes.InvalidArgument, "cannot publish a non-block volume as block volume")
 		}
 
-		volPathHandler := volumepathhandler.VolumePathHandler{}
-
-		// Get loop device from the volume path.
-		loopDevice, err := volPathHandler.GetLoopDevice(vol.Path)
+		// Get loop device from the volume path, attaching one if it went away since the volume was created.
+		loopDevice, err := ns.node.loop.AttachFileDevice(vol.Path)
 		if err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to get the loop device: %v", err))
 		}
 
-		mounter := mount.New("")
+		mounter := ns.mounter
 
 		// Check if the target path exists. Create if not present.
 		_, err = os.Lstat(targetPath)
@@ -126,15 +222,19 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
 
-		if err := mount.New("").Mount(loopDevice, targetPath, "", []string{"bind"}); err != nil {
+		options := []string{"bind"}
+		if req.GetReadonly() {
+			options = append(options, "ro")
+		}
+		if err := mounter.Mount(loopDevice, targetPath, "", options); err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to mount block device: %s at %s: %v", loopDevice, targetPath, err))
 		}
 	} else if req.GetVolumeCapability().GetMount() != nil {
-		if vol.AccessType != mountAccess {
+		if vol.AccessType == blockAccess {
 			return nil, status.Error(codes.InvalidArgument, "cannot publish a non-mount volume as mount volume")
 		}
 
-		notMnt, err := mount.IsNotMountPoint(mount.New(""),targetPath)
+		notMnt, err := mount.IsNotMountPoint(ns.mounter, targetPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				if err = os.MkdirAll(targetPath, 0750); err != nil {
@@ -150,8 +250,6 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
 
-		fsType := req.GetVolumeCapability().GetMount().GetFsType()
-
 		deviceId := ""
 		if req.GetPublishContext() != nil {
 			deviceId = req.GetPublishContext()[deviceID]
@@ -173,55 +271,68 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			mountFlags,
 		)
 
-		options := []string{"bind"}
-		if readOnly {
-			options = append(options, "ro")
-		}
-		mounter := mount.New("")
-		volumePath := fullpath(ns.node.workdir, podUUID, volumeId)
-
-		if err := mounter.Mount(volumePath, targetPath, "", options); err != nil {
-			var errList strings.Builder
-			errList.WriteString(err.Error())
-			if vol.Ephemeral {
-				if rmErr := os.RemoveAll(volumePath); rmErr != nil && !os.IsNotExist(rmErr) {
-					errList.WriteString(fmt.Sprintf(" :%s", rmErr.Error()))
+		if vol.AccessType == imageAccess {
+			if err := ns.mountImage(vol, targetPath, readOnly, mountFlags); err != nil {
+				return nil, err
+			}
+			// The root of the filesystem belongs to whoever formatted it until handed over to the pod
+			if !readOnly {
+				if err := owner.apply(targetPath); err != nil {
+					return nil, status.Error(codes.Internal, err.Error())
 				}
 			}
-			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to mount device: %s at %s: %s", volumePath, targetPath, errList.String()))
+		} else if err := ns.bindMount(vol, targetPath, readOnly); err != nil {
+			return nil, err
 		}
 	} else {
 		return nil, status.Error(codes.InvalidArgument, "volume must be of block or mount access type")
 	}
 
+	// Remember where the volume is mounted so that reconciliation can tell whether it is still in use
+	ephVol.TargetPath = targetPath
+	ephVol.PodName = pod.Name
+	ephVol.PodNamespace = pod.Namespace
+	ns.node.setVolume(*ephVol)
+
 	// Persist newly created ephemeral volume into storage due to the fact that we need the PodUUID information
 	// when deleting this object.
-	err = ns.node.storage.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(volumesBucketName))
-		if bucket == nil {
-			return fmt.Errorf("bucket %s does not exist", volumesBucketName)
-		}
-
-		marshaledVol, err := json.Marshal(*ephVol)
-		if err != nil {
-			return fmt.Errorf("unable to serialize deletion candidate: %w", err)
-		}
-
-		err = bucket.Put([]byte(volID), marshaledVol)
-		if err != nil {
-			return fmt.Errorf("unable to insert volume %s into database: %w", volID, err)
-		}
-
-		return nil
-	})
-
-	if err != nil {
+	if err := ns.node.saveVolume(*ephVol); err != nil {
 		glog.Errorf("Unable to persist volume %s: %s", volID, err)
 	}
 
+	ns.node.events.podEvent(pod, v1.EventTypeNormal, volumePublished, "Published volume %s%s", volID, describeLimits(ephVol))
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// bindMount bind mounts the directory of a mount volume at the target path. The directory of an
+// ephemeral volume is removed when it can't be mounted.
+func (ns *nodeServer) bindMount(vol volume, targetPath string, readOnly bool) error {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	mounter := ns.mounter
+	volumePath := fullpath(ns.node.poolOf(vol.Pool).workdir, vol.PodUUID, vol.ID)
+
+	if err := mounter.Mount(volumePath, targetPath, "", options); err != nil {
+		var errList strings.Builder
+		errList.WriteString(err.Error())
+		if vol.Ephemeral {
+			if rmErr := os.RemoveAll(volumePath); rmErr != nil && !os.IsNotExist(rmErr) {
+				errList.WriteString(fmt.Sprintf(" :%s", rmErr.Error()))
+			} else if qErr := ns.node.poolOf(vol.Pool).quota.release(vol.ProjectID); qErr != nil {
+				errList.WriteString(fmt.Sprintf(" :%s", qErr.Error()))
+			} else {
+				// The record would otherwise be reused by the next attempt, pointing at a directory that is
+				// gone and at a project ID which may already belong to another volume.
+				ns.node.forgetVolume(vol.ID)
+			}
+		}
+		return status.Error(codes.Internal, fmt.Sprintf("failed to mount device: %s at %s: %s", volumePath, targetPath, errList.String()))
+	}
+	return nil
+}
+
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 
 	// Validate the request that was sent
@@ -236,6 +347,12 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	var err error
 	targetPath := req.GetTargetPath()
 	volumeID := req.GetVolumeId()
+
+	if !ns.node.locks.tryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", volumeID)
+	}
+	defer ns.node.locks.release(volumeID)
+
 	vol, err = ns.node.volumeByID(volumeID)
 
 	if err != nil {
@@ -244,52 +361,36 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		glog.Warningf("handling deletion for volume %v even though it is not ephemeral", vol)
 	}
 
-	// Queue folder that was previously mounted on to pod for deletion. Note that this is different
-	// than the point where the folder was bind mounted to.
-	ns.node.deletedVolumes.queue(
-		volumeID,
-		deletionCandidate{
-			Time:     time.Now(),
-			Lifespan: ns.node.afterLifespan,
-			Path:     fullpath(ns.node.workdir, vol.PodUUID, volumeID),
-		},
-	)
-
 	// Unmount only if the target path is really a mount point.
 	// This will not delete the underlying data stored in the working directory.
-	notMnt, err := mount.IsNotMountPoint(mount.New(""), targetPath)
+	notMnt, err := mount.IsNotMountPoint(ns.mounter, targetPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else if !notMnt {
 		// Un-mounting the image or filesystem.
-		err = mount.New("").Unmount(targetPath)
+		err = ns.mounter.Unmount(targetPath)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
 	if vol.AccessType == blockAccess {
-			return nil, fmt.Errorf("block access is unsupported by this driver")
+		// The file the loop device was bind mounted onto was created when publishing
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "failed to remove target path %s: %v", targetPath, err)
+		}
 	}
 
-	// Delete persisted volume information
-	err = ns.node.storage.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(volumesBucketName))
-
-		err := bucket.Delete([]byte(volumeID))
-		if err != nil {
-			return fmt.Errorf("unable to delete %s from permanent storage: %s", volumeID, err)
+	if vol.AccessType.usesLoopDevice() {
+		// The backing file is only removed by the pruner once it's no longer attached
+		if err := ns.node.loop.DetachFileDevice(vol.Path); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to detach the loop device of %s: %v", vol.Path, err)
 		}
-		return nil
-	})
-
-	if err != nil {
-		glog.Error(err)
 	}
 
-	delete(ns.node.volumes, volumeID)
+	ns.node.queueForDeletion(volumeID, vol)
 
 	// Since we've already successfully queued the local volume for deletion, we return
 	// a payload indicating that the delete request was successful. The actual deletion from the local
@@ -341,18 +442,223 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 		Capabilities: []*csi.NodeServiceCapability{
 			{
 				Type: &csi.NodeServiceCapability_Rpc{
-					Rpc: &csi.NodeServiceCapability_RPC{},
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
 				},
 			},
 		},
 	}, nil
 }
 
-func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, in *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+
+	vol, err := ns.node.volumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	// Stats are gathered from the directory inside the working directory rather than from the
+	// target path since the latter is only a bind mount of the former. Viewers are bind mounts of the
+	// retained volume's directory and have none of their own.
+	volumePath := fullpath(ns.node.poolOf(vol.Pool).workdir, vol.PodUUID, vol.ID)
+	if vol.Retained != "" {
+		volumePath = vol.Path
+	}
+	if _, err := os.Stat(volumePath); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "unable to stat volume %s at %s: %v", vol.ID, volumePath, err)
+		}
+
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("volume path %s does not exist", volumePath),
+			},
+		}, nil
+	}
+
+	if vol.AccessType == blockAccess {
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Total: vol.Size,
+					Unit:  csi.VolumeUsage_BYTES,
+				},
+			},
+			VolumeCondition: ns.volumeCondition(&csi.VolumeCondition{}),
+		}, nil
+	}
+
+	// Image volumes hold a filesystem of their own which is only visible through the target path
+	if vol.AccessType == imageAccess {
+		available, capacity, used, inodes, inodesFree, inodesUsed, err := fs.Info(req.GetVolumePath())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to get filesystem info for %s: %v", req.GetVolumePath(), err)
+		}
+
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{Available: available, Total: capacity, Used: used, Unit: csi.VolumeUsage_BYTES},
+				{Available: inodesFree, Total: inodes, Used: inodesUsed, Unit: csi.VolumeUsage_INODES},
+			},
+			VolumeCondition: ns.volumeCondition(&csi.VolumeCondition{}),
+		}, nil
+	}
+
+	available, capacity, _, inodes, inodesFree, _, err := fs.Info(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to get filesystem info for %s: %v", volumePath, err)
+	}
+
+	usage, err := fs.DiskUsage(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to get disk usage for %s: %v", volumePath, err)
+	}
+
+	// Volumes given a size report it as their capacity as long as it fits in the underlying filesystem.
+	if vol.Size < capacity {
+		capacity = vol.Size
+		available = int64(math.Max(0, math.Min(float64(available), float64(vol.Size-usage.Bytes))))
+	}
+	if vol.Inodes > 0 && vol.Inodes < inodes {
+		inodes = vol.Inodes
+		inodesFree = int64(math.Max(0, math.Min(float64(inodesFree), float64(vol.Inodes-usage.Inodes))))
+	}
+
+	condition := &csi.VolumeCondition{}
+	if vol.OverLimit {
+		condition = &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "volume is using more than its size limit",
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Available: available,
+				Total:     capacity,
+				Used:      usage.Bytes,
+				Unit:      csi.VolumeUsage_BYTES,
+			},
+			{
+				Available: inodesFree,
+				Total:     inodes,
+				Used:      usage.Inodes,
+				Unit:      csi.VolumeUsage_INODES,
+			},
+		},
+		VolumeCondition: ns.volumeCondition(condition),
+	}, nil
 }
 
-// NodeExpandVolume is only implemented so the driver can be used for e2e testing.
+// volumeCondition adds the pruner's heartbeat to the condition of a healthy volume. The volume is reported as
+// abnormal once the pruner has stalled, as the space of the volumes deleted on the node is no longer reclaimed.
+func (ns *nodeServer) volumeCondition(condition *csi.VolumeCondition) *csi.VolumeCondition {
+	if condition.GetAbnormal() {
+		return condition
+	}
+
+	interval, _ := ns.node.deletedVolumes.settings.get()
+	lastRound := ns.node.deletedVolumes.lastRoundTime()
+	if stall := interval * time.Duration(ns.pruneStallMultiple); stall > 0 && time.Since(lastRound) > stall {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("pruner has not finished a round since %s", lastRound.Format(time.RFC3339)),
+		}
+	}
+	return &csi.VolumeCondition{Message: fmt.Sprintf("pruner last finished a round at %s", lastRound.Format(time.RFC3339))}
+}
+
+// NodeExpandVolume grows a volume while it is in use. The project quota of directory volumes is raised, or
+// their soft limit on filesystems without project quotas, while image volumes get their image and filesystem grown.
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+
+	size := req.GetCapacityRange().GetRequiredBytes()
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && size > limit {
+		return nil, status.Errorf(codes.InvalidArgument, "required bytes %d exceed the limit of %d bytes", size, limit)
+	}
+	if size <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "required bytes missing in request")
+	}
+	if size > maxStorageCapacity {
+		return nil, status.Errorf(codes.OutOfRange, "volumes cannot be larger than %d bytes", maxStorageCapacity)
+	}
+
+	if !ns.node.locks.tryAcquire(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer ns.node.locks.release(req.GetVolumeId())
+
+	vol, err := ns.node.volumeByID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if vol.Retained != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s shows retained volume %s read only", vol.ID, vol.Retained)
+	}
+
+	// Volumes are never shrunk, asking for less than they have is a no-op
+	if size <= vol.Size {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: vol.Size}, nil
+	}
+
+	switch vol.AccessType {
+	case mountAccess:
+		if vol.ProjectID != 0 {
+			if err := ns.node.poolOf(vol.Pool).quota.resize(vol.ProjectID, size, vol.Inodes); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	case imageAccess:
+		if err := ns.expandImage(vol, req.GetVolumePath(), size); err != nil {
+			return nil, err
+		}
+		size = roundUpToMiB(size)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "%s volumes cannot be expanded", vol.AccessType)
+	}
+
+	glog.Infof("expanded volume %s from %d to %d bytes", vol.ID, vol.Size, size)
+	vol.Size = size
+	ns.node.setVolume(vol)
+	if err := ns.node.saveVolume(vol); err != nil {
+		glog.Errorf("Unable to persist volume %s: %s", vol.ID, err)
+	}
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 }
@@ -0,0 +1,324 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	workdir := t.TempDir()
+	ns := &nodeServer{node: &node{
+		workdir: workdir,
+		volumes: map[string]volume{
+			"vol1": {ID: "vol1", PodUUID: "pod1", AccessType: mountAccess},
+			"vol2": {ID: "vol2", PodUUID: "pod2", AccessType: mountAccess},
+		},
+	}}
+
+	volPath := fullpath(workdir, "pod1", "vol1")
+	require.NoError(t, os.MkdirAll(volPath, 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(volPath, "data"), make([]byte, 4096), 0644))
+
+	t.Run("healthy", func(t *testing.T) {
+		resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   "vol1",
+			VolumePath: "/target/vol1",
+		})
+		require.NoError(t, err)
+		assert.False(t, resp.GetVolumeCondition().GetAbnormal())
+		assert.Contains(t, resp.GetVolumeCondition().GetMessage(), "pruner last finished a round at")
+		require.Len(t, resp.GetUsage(), 2)
+		assert.Equal(t, csi.VolumeUsage_BYTES, resp.GetUsage()[0].GetUnit())
+		assert.GreaterOrEqual(t, resp.GetUsage()[0].GetUsed(), int64(4096))
+		assert.Equal(t, csi.VolumeUsage_INODES, resp.GetUsage()[1].GetUnit())
+		assert.GreaterOrEqual(t, resp.GetUsage()[1].GetUsed(), int64(2))
+	})
+
+	t.Run("stalledPruner", func(t *testing.T) {
+		stalled := &nodeServer{node: ns.node, pruneStallMultiple: 10}
+		stalled.node.deletedVolumes.settings.set(time.Second, 0.1, 0)
+		stalled.node.deletedVolumes.lastRound = time.Now().Add(-time.Minute).UnixNano()
+		defer stalled.node.deletedVolumes.settings.set(0, 0, 0)
+
+		resp, err := stalled.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   "vol1",
+			VolumePath: "/target/vol1",
+		})
+		require.NoError(t, err)
+		assert.True(t, resp.GetVolumeCondition().GetAbnormal())
+		assert.Contains(t, resp.GetVolumeCondition().GetMessage(), "pruner has not finished a round since")
+		assert.Len(t, resp.GetUsage(), 2, "usage should still be reported")
+	})
+
+	t.Run("vanished", func(t *testing.T) {
+		resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   "vol2",
+			VolumePath: "/target/vol2",
+		})
+		require.NoError(t, err)
+		assert.True(t, resp.GetVolumeCondition().GetAbnormal())
+		assert.Empty(t, resp.GetUsage())
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   "vol3",
+			VolumePath: "/target/vol3",
+		})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+// newTestNode returns a node backed by persistent storage inside a temporary working directory.
+func newTestNode(t *testing.T) *node {
+	workdir := t.TempDir()
+	db, err := initializePermanentStorage(filepath.Join(workdir, "deletedVolumes.db"), deletedVolumesBucketName, volumesBucketName)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return &node{
+		id:      "node",
+		volumes: make(map[string]volume),
+		deletedVolumes: deletedVolumes{
+			candidates: make(map[string]*deletionCandidate),
+			storage:    db,
+			lastRound:  time.Now().UnixNano(),
+		},
+		workdir:       workdir,
+		volumeMode:    defaultVolumeMode,
+		afterLifespan: time.Hour,
+		storage:       db,
+	}
+}
+
+// recordingExec runs no command, it records up to ten of them and replies with the output given for each command name.
+func recordingExec(commands *[]string, outputs map[string]string) *testingexec.FakeExec {
+	action := func(cmd string, args ...string) utilexec.Cmd {
+		*commands = append(*commands, strings.Join(append([]string{cmd}, args...), " "))
+		return &testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) { return []byte(outputs[cmd]), nil, nil },
+			},
+		}
+	}
+
+	fake := &testingexec.FakeExec{}
+	for i := 0; i < 10; i++ {
+		fake.CommandScript = append(fake.CommandScript, action)
+	}
+	return fake
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	n := ns.node
+	loop := withFakeLoopDevices(n)
+	var commands []string
+	ns.exec = recordingExec(&commands, map[string]string{"blkid": "DEVNAME=/dev/loop0\nTYPE=ext4\n"})
+
+	expand := func(id string, required, limit int64) (*csi.NodeExpandVolumeResponse, error) {
+		return ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+			VolumeId:      id,
+			VolumePath:    "/target/" + id,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: required, LimitBytes: limit},
+		})
+	}
+
+	// A directory volume on a filesystem without project quotas has its soft limit raised
+	publishTestVolume(t, n, "dir", "pod1")
+	vol, err := n.volumeByID("dir")
+	require.NoError(t, err)
+	vol.Size = gib
+	n.setVolume(vol)
+
+	resp, err := expand("dir", 2*gib, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2*gib, resp.GetCapacityBytes())
+	vol, err = n.volumeByID("dir")
+	require.NoError(t, err)
+	assert.Equal(t, 2*gib, vol.Size)
+
+	persisted, err := loadVolumesFromPersistent(n.storage, volumesBucketName)
+	require.NoError(t, err)
+	assert.Equal(t, 2*gib, persisted["dir"].Size, "new size should be persisted")
+
+	// Volumes are never shrunk
+	resp, err = expand("dir", gib, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2*gib, resp.GetCapacityBytes())
+
+	// Image volumes get their image, loop device and filesystem grown
+	path := fullpath(n.workdir, "pod1", "image")
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	require.NoError(t, os.Truncate(path, 8*mib))
+	n.setVolume(volume{ID: "image", PodUUID: "pod1", Path: path, Size: 8 * mib, AccessType: imageAccess, FsType: "ext4", Ephemeral: true})
+
+	resp, err = expand("image", 15*mib+1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 16*mib, resp.GetCapacityBytes())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, 16*mib, info.Size())
+	device := loop.devices[path]
+	require.Len(t, commands, 3)
+	assert.Equal(t, "losetup -c "+device, commands[0])
+	assert.Contains(t, commands[1], "blkid")
+	assert.Equal(t, "resize2fs "+device, commands[2])
+
+	_, err = expand("missing", gib, 0)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = expand("dir", 4*gib, 3*gib)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = expand("dir", 2*tib, 0)
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	n.setVolume(volume{ID: "block", PodUUID: "pod1", Size: mib, AccessType: blockAccess})
+	_, err = expand("block", gib, 0)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	resp, err := ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	require.NoError(t, err)
+
+	var capabilities []csi.NodeServiceCapability_RPC_Type
+	for _, c := range resp.GetCapabilities() {
+		capabilities = append(capabilities, c.GetRpc().GetType())
+	}
+	assert.ElementsMatch(t, []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+	}, capabilities)
+}
+
+// failingMounter fails every mount for as long as fail is set.
+type failingMounter struct {
+	*mount.FakeMounter
+	fail bool
+}
+
+func (m *failingMounter) Mount(source, target, fstype string, options []string) error {
+	if m.fail {
+		return errors.New("mount failed")
+	}
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+func TestPublishRetryAfterFailedMount(t *testing.T) {
+	mounter := &failingMounter{FakeMounter: mount.NewFakeMounter(nil), fail: true}
+	ns := &nodeServer{node: newTestNode(t), mounter: mounter}
+	targetDir := t.TempDir()
+	volumePath := fullpath(ns.node.workdir, "pod1", "vol1")
+
+	_, err := ns.NodePublishVolume(context.Background(), publishRequest(targetDir, "vol1", "pod1"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NoDirExists(t, volumePath)
+	_, err = ns.node.volumeByID("vol1")
+	assert.Error(t, err, "the record of a volume whose directory was removed should be dropped")
+
+	// The kubelet's retry creates the volume from scratch
+	mounter.fail = false
+	_, err = ns.NodePublishVolume(context.Background(), publishRequest(targetDir, "vol1", "pod1"))
+	require.NoError(t, err)
+	assert.DirExists(t, volumePath)
+	vol, err := ns.node.volumeByID("vol1")
+	require.NoError(t, err)
+	assert.Equal(t, volumePath, vol.Path)
+	assert.Equal(t, filepath.Join(targetDir, "vol1"), vol.TargetPath)
+}
+
+func TestPublishOverExistingDirectory(t *testing.T) {
+	ns, mounter := newTestNodeServer(t)
+	volumePath := fullpath(ns.node.workdir, "pod1", "vol1")
+
+	// A volume whose record was lost in a crash, with the data its pod wrote
+	require.NoError(t, os.MkdirAll(volumePath, 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(volumePath, "data"), []byte("keep"), 0600))
+
+	_, err := ns.NodePublishVolume(context.Background(), publishRequest(t.TempDir(), "vol1", "pod1"))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "already exists")
+
+	data, err := ioutil.ReadFile(filepath.Join(volumePath, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, "keep", string(data), "the existing directory should be left alone")
+	assert.NoDirExists(t, stagingPath(volumePath))
+	_, err = ns.node.volumeByID("vol1")
+	assert.Error(t, err)
+	mountPoints, err := mounter.List()
+	require.NoError(t, err)
+	assert.Empty(t, mountPoints)
+}
+
+func TestCheckSoftLimits(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	n := ns.node
+	recorder := newTestEventRecorder(n)
+
+	req := publishRequest(t.TempDir(), "vol1", "pod1")
+	req.VolumeContext[sizeContext] = "4Ki"
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err)
+	nextEvent(t, recorder)
+
+	vol, err := n.volumeByID("vol1")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vol.Path, "data"), make([]byte, 64*1024), 0600))
+
+	n.checkSoftLimits()
+	vol, err = n.volumeByID("vol1")
+	require.NoError(t, err)
+	assert.True(t, vol.OverLimit)
+	persisted, err := loadVolumesFromPersistent(n.storage, volumesBucketName)
+	require.NoError(t, err)
+	assert.True(t, persisted["vol1"].OverLimit, "the flag should survive a restart")
+	event, _ := nextEvent(t, recorder)
+	assert.Contains(t, event, "Warning VolumeOverLimit")
+	assert.Contains(t, event, "Volume vol1 is using")
+
+	// Checking again records nothing new
+	n.checkSoftLimits()
+	assert.Empty(t, recorder.Events)
+
+	require.NoError(t, os.Remove(filepath.Join(vol.Path, "data")))
+	n.checkSoftLimits()
+	persisted, err = loadVolumesFromPersistent(n.storage, volumesBucketName)
+	require.NoError(t, err)
+	assert.False(t, persisted["vol1"].OverLimit)
+}
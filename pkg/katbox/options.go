@@ -0,0 +1,243 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Options configures the katbox driver.
+type Options struct {
+	DriverName        string
+	NodeID            string
+	Endpoint          string
+	Workdir           string
+	MaxVolumesPerNode int64
+
+	// Pools are the storage pools volumes may ask for besides the default pool, which lives in Workdir.
+	Pools []PoolOptions
+
+	// TemplatesDir holds the directories and tar archives new volumes may be seeded from.
+	TemplatesDir string
+
+	// VolumeMode is the octal mode of volume directories which don't ask for another.
+	VolumeMode string
+
+	// AfterlifeSpan is how long a volume is kept after being unpublished. Pods may request a different
+	// retention, which is kept between MinAfterlifeSpan and MaxAfterlifeSpan. A zero MaxAfterlifeSpan means unbounded.
+	AfterlifeSpan    time.Duration
+	MinAfterlifeSpan time.Duration
+	MaxAfterlifeSpan time.Duration
+
+	// PruneInterval, Headroom and InodeHeadroom may be changed while the driver runs through Reload.
+	// InodeHeadroom is the share of inodes kept free, zero leaves inodes out of the pressure factor.
+	PruneInterval time.Duration
+	Headroom      float64
+	InodeHeadroom float64
+
+	DeleteTimeout      time.Duration
+	MaxDeleteAttempts  int
+	PruneStallMultiple int
+	EvictionPolicy     string
+
+	// PressureCurve turns the utilization of a pool into its pressure factor: linear, exponential or a list
+	// of steps such as "85%=0.5, 95%=0.1". PressureFloor is the lowest factor applied for as long as the share
+	// of free space and inodes stays above CriticalHeadroom.
+	PressureCurve    string
+	PressureFloor    float64
+	CriticalHeadroom float64
+
+	SoftLimitInterval time.Duration
+	ReconcileInterval time.Duration
+
+	MetricsAddress string
+	AdminEndpoint  string
+
+	// KubeClient is used to watch pods and emit events. When nil, a client is created
+	// from Kubeconfig, or the pod's service account when Kubeconfig is empty.
+	KubeClient       kubernetes.Interface
+	Kubeconfig       string
+	WatchPods        bool
+	PodSweepInterval time.Duration
+	EmitEvents       bool
+	EventQPS         float64
+	EventBurst       int
+
+	Version string
+}
+
+// PoolOptions configures a storage pool.
+type PoolOptions struct {
+	Name    string
+	Workdir string
+
+	// Headroom and AfterlifeSpan default to the node's when nil and zero respectively.
+	Headroom      *float64
+	AfterlifeSpan time.Duration
+}
+
+// DefaultOptions returns the options used for any setting left unset by flags and configuration files.
+func DefaultOptions() Options {
+	return Options{
+		DriverName:         "katbox.csi.paypal.com",
+		Endpoint:           "unix://tmp/csi.sock",
+		Workdir:            "/csi-data-dir",
+		AfterlifeSpan:      time.Hour * 12,
+		PruneInterval:      time.Second * 5,
+		Headroom:           0.1,
+		VolumeMode:         fmt.Sprintf("%04o", defaultVolumeMode),
+		DeleteTimeout:      time.Minute,
+		MaxDeleteAttempts:  5,
+		PruneStallMultiple: 10,
+		EvictionPolicy:     "time",
+		PressureCurve:      linearPressure,
+		CriticalHeadroom:   0.02,
+		SoftLimitInterval:  time.Minute,
+		AdminEndpoint:      "unix://tmp/katbox-admin.sock",
+		PodSweepInterval:   time.Minute * 5,
+		EventQPS:           1.0 / 300,
+		EventBurst:         25,
+	}
+}
+
+// Validate returns an error describing why the options are invalid, if they are.
+func (o *Options) Validate() error {
+	if o.DriverName == "" {
+		return errors.New("no driver name provided")
+	}
+
+	if o.NodeID == "" {
+		return errors.New("no node id provided")
+	}
+
+	if o.Endpoint == "" {
+		return errors.New("no driver endpoint provided")
+	}
+
+	if o.Workdir == "" {
+		return errors.New("no working directory provided")
+	}
+
+	if _, err := parseVolumeMode(o.VolumeMode); err != nil {
+		return fmt.Errorf("invalid volume mode: %w", err)
+	}
+
+	if o.MaxVolumesPerNode < 0 {
+		return errors.New("maximum number of volumes per node cannot be negative")
+	}
+
+	for name, d := range map[string]time.Duration{
+		"afterlife span":         o.AfterlifeSpan,
+		"minimum afterlife span": o.MinAfterlifeSpan,
+		"maximum afterlife span": o.MaxAfterlifeSpan,
+		"delete timeout":         o.DeleteTimeout,
+		"reconcile interval":     o.ReconcileInterval,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+
+	for name, d := range map[string]time.Duration{
+		"prune interval":      o.PruneInterval,
+		"soft limit interval": o.SoftLimitInterval,
+		"pod sweep interval":  o.PodSweepInterval,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+
+	if o.MaxAfterlifeSpan > 0 && o.MinAfterlifeSpan > o.MaxAfterlifeSpan {
+		return errors.New("minimum afterlife span cannot be greater than the maximum afterlife span")
+	}
+
+	if o.Headroom < 0.0 || o.Headroom > 1.0 {
+		return errors.New("headroom must be a value between 0 and 1.0 (inclusive)")
+	}
+
+	if o.InodeHeadroom < 0.0 || o.InodeHeadroom > 1.0 {
+		return errors.New("inode headroom must be a value between 0 and 1.0 (inclusive)")
+	}
+
+	if o.MaxDeleteAttempts < 0 || o.PruneStallMultiple < 0 {
+		return errors.New("maximum number of delete attempts and prune stall multiple cannot be negative")
+	}
+
+	if _, err := newEvictionPolicy(o.EvictionPolicy); err != nil {
+		return err
+	}
+
+	if _, err := newPressureCurve(o.PressureCurve); err != nil {
+		return err
+	}
+
+	if o.PressureFloor < 0.0 || o.PressureFloor > 1.0 {
+		return errors.New("pressure floor must be a value between 0 and 1.0 (inclusive)")
+	}
+
+	if o.CriticalHeadroom < 0.0 || o.CriticalHeadroom > 1.0 {
+		return errors.New("critical headroom must be a value between 0 and 1.0 (inclusive)")
+	}
+
+	if o.EventQPS < 0 || o.EventBurst < 0 {
+		return errors.New("event rate limits cannot be negative")
+	}
+
+	return validatePools(o.Workdir, o.Pools)
+}
+
+func validatePools(workdir string, pools []PoolOptions) error {
+	names := map[string]bool{defaultPoolName: true}
+	workdirs := []string{filepath.Clean(workdir)}
+	for _, p := range pools {
+		if p.Name == "" || p.Workdir == "" {
+			return errors.New("every pool needs a name and a working directory")
+		}
+
+		if names[p.Name] {
+			return fmt.Errorf("pool %s is defined more than once", p.Name)
+		}
+		names[p.Name] = true
+
+		// Reconciliation would mistake the volumes of a nested pool for orphans of the outer one
+		dir := filepath.Clean(p.Workdir)
+		for _, other := range workdirs {
+			if dir == other || strings.HasPrefix(dir, other+string(filepath.Separator)) ||
+				strings.HasPrefix(other, dir+string(filepath.Separator)) {
+				return fmt.Errorf("working directory %s of pool %s overlaps with %s", p.Workdir, p.Name, other)
+			}
+		}
+		workdirs = append(workdirs, dir)
+
+		if p.Headroom != nil && (*p.Headroom < 0.0 || *p.Headroom > 1.0) {
+			return fmt.Errorf("headroom of pool %s must be a value between 0 and 1.0 (inclusive)", p.Name)
+		}
+
+		if p.AfterlifeSpan < 0 {
+			return fmt.Errorf("afterlife span of pool %s cannot be negative", p.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultVolumeMode is the mode given to volume directories when neither the volume nor the driver asks for another.
+const defaultVolumeMode os.FileMode = 0770
+
+// volumeOwner is the ownership and permissions a directory volume is created with.
+// A negative uid or gid leaves the owner or group to the plugin's.
+type volumeOwner struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+
+	// mountGroup is set when the group comes from the pod's fsGroup, in which case the volume is made
+	// writable by the group, and so is the content of its template, as the kubelet would have.
+	mountGroup bool
+}
+
+// parseVolumeMode parses an octal permission mode, e.g. 0750.
+func parseVolumeMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q: must be octal permissions between 0000 and 0777", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseID parses a user or group ID.
+func parseID(value string) (int, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q must be a non negative integer", value)
+	}
+	return int(id), nil
+}
+
+// volumeOwnership determines the ownership and permissions of a new volume from its attributes and the
+// volume mount group the kubelet passes for the pod's fsGroup. An explicit gid attribute wins over the fsGroup.
+func volumeOwnership(attributes map[string]string, mountGroup string, defaultMode os.FileMode) (volumeOwner, error) {
+	owner := volumeOwner{uid: -1, gid: -1, mode: defaultMode}
+
+	if value, ok := attributes[uidContext]; ok {
+		uid, err := parseID(value)
+		if err != nil {
+			return owner, fmt.Errorf("invalid %s attribute: %w", uidContext, err)
+		}
+		owner.uid = uid
+	}
+
+	if value, ok := attributes[gidContext]; ok {
+		gid, err := parseID(value)
+		if err != nil {
+			return owner, fmt.Errorf("invalid %s attribute: %w", gidContext, err)
+		}
+		owner.gid = gid
+	} else if mountGroup != "" {
+		gid, err := parseID(mountGroup)
+		if err != nil {
+			return owner, fmt.Errorf("invalid volume mount group: %w", err)
+		}
+		owner.gid = gid
+		owner.mountGroup = true
+	}
+
+	if value, ok := attributes[modeContext]; ok {
+		mode, err := parseVolumeMode(value)
+		if err != nil {
+			return owner, fmt.Errorf("invalid %s attribute: %w", modeContext, err)
+		}
+		owner.mode = mode
+	}
+
+	return owner, nil
+}
+
+// apply sets the ownership and permissions of the volume directory. The content seeded from a template
+// keeps its own, except for being handed over to the mount group.
+func (o volumeOwner) apply(dir string) error {
+	if o.mountGroup {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == dir {
+				return err
+			}
+			if err := os.Lchown(path, -1, o.gid); err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return nil
+			}
+			return os.Chmod(path, groupWritable(info.Mode()))
+		})
+		if err != nil {
+			return fmt.Errorf("unable to hand %s over to group %d: %w", dir, o.gid, err)
+		}
+	}
+
+	if err := os.Chown(dir, o.uid, o.gid); err != nil {
+		return fmt.Errorf("unable to change owner of %s: %w", dir, err)
+	}
+
+	mode := o.mode
+	if o.mountGroup {
+		mode = groupWritable(mode | os.ModeDir)
+	}
+	// Chmod is not subject to the umask, unlike the creation of the directory
+	if err := os.Chmod(dir, mode); err != nil {
+		return fmt.Errorf("unable to change mode of %s: %w", dir, err)
+	}
+	return nil
+}
+
+// groupWritable adds the permissions the kubelet grants the fsGroup: read and write, plus search and
+// inheritance of the group for directories.
+func groupWritable(mode os.FileMode) os.FileMode {
+	mode |= 0060
+	if mode.IsDir() {
+		mode |= 0010 | os.ModeSetgid
+	}
+	return mode
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeOwnership(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		mountGroup string
+		expected   volumeOwner
+		err        string
+	}{
+		{
+			name:     "defaults",
+			expected: volumeOwner{uid: -1, gid: -1, mode: 0770},
+		},
+		{
+			name:       "attributes",
+			attributes: map[string]string{uidContext: "1000", gidContext: "2000", modeContext: "0750"},
+			expected:   volumeOwner{uid: 1000, gid: 2000, mode: 0750},
+		},
+		{
+			name:       "fsGroup",
+			mountGroup: "3000",
+			expected:   volumeOwner{uid: -1, gid: 3000, mode: 0770, mountGroup: true},
+		},
+		{
+			name:       "gid overrides fsGroup",
+			attributes: map[string]string{gidContext: "2000"},
+			mountGroup: "3000",
+			expected:   volumeOwner{uid: -1, gid: 2000, mode: 0770},
+		},
+		{
+			name:       "negative uid",
+			attributes: map[string]string{uidContext: "-1"},
+			err:        "invalid uid attribute",
+		},
+		{
+			name:       "named gid",
+			attributes: map[string]string{gidContext: "users"},
+			err:        "invalid gid attribute",
+		},
+		{
+			name:       "decimal mode",
+			attributes: map[string]string{modeContext: "493"},
+			err:        "invalid mode attribute",
+		},
+		{
+			name:       "special bits",
+			attributes: map[string]string{modeContext: "4755"},
+			err:        "invalid mode attribute",
+		},
+		{
+			name:       "invalid fsGroup",
+			mountGroup: "nogroup",
+			err:        "invalid volume mount group",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, err := volumeOwnership(tt.attributes, tt.mountGroup, defaultVolumeMode)
+			if tt.err != "" {
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, owner)
+		})
+	}
+}
+
+func TestPublishWithOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of volumes requires root")
+	}
+
+	ns, _ := newTestNodeServer(t)
+	withTemplates(t, ns.node)
+
+	req := publishRequest(t.TempDir(), "owned", "pod1")
+	req.VolumeContext[uidContext] = "1000"
+	req.VolumeContext[gidContext] = "2000"
+	req.VolumeContext[modeContext] = "0750"
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err)
+
+	vol, err := ns.node.volumeByID("owned")
+	require.NoError(t, err)
+	info, err := os.Stat(vol.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	assert.Equal(t, uint32(1000), info.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, uint32(2000), info.Sys().(*syscall.Stat_t).Gid)
+	assert.NoDirExists(t, stagingPath(vol.Path), "staging directory should have been moved in place")
+
+	// The pod's fsGroup gets the volume and its template
+	req = publishRequest(t.TempDir(), "grouped", "pod1")
+	req.VolumeCapability.GetMount().VolumeMountGroup = "3000"
+	req.VolumeContext[templateContext] = "tools"
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err)
+
+	vol, err = ns.node.volumeByID("grouped")
+	require.NoError(t, err)
+	for path, mode := range map[string]os.FileMode{
+		vol.Path:                              os.ModeDir | os.ModeSetgid | 0770,
+		filepath.Join(vol.Path, "bin"):        os.ModeDir | os.ModeSetgid | 0775,
+		filepath.Join(vol.Path, "bin", "run"): 0770,
+	} {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, mode, info.Mode(), path)
+		assert.Equal(t, uint32(3000), info.Sys().(*syscall.Stat_t).Gid, path)
+	}
+}
+
+func TestPublishWithDefaultMode(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	ns.node.volumeMode = 0700
+
+	_, err := ns.NodePublishVolume(context.Background(), publishRequest(t.TempDir(), "private", "pod1"))
+	require.NoError(t, err)
+
+	vol, err := ns.node.volumeByID("private")
+	require.NoError(t, err)
+	info, err := os.Stat(vol.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	req := blockPublishRequest(t.TempDir(), "block", "pod1")
+	req.VolumeContext[modeContext] = "0700"
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "block volumes don't have a mode")
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	bolt "go.etcd.io/bbolt"
+)
+
+// podsBucketName holds a bucket per pod UUID listing the IDs of the pod's volumes queued for deletion.
+const podsBucketName = "deletedPods"
+
+// indexCandidate records that the candidate belongs to the pod within the transaction.
+func indexCandidate(tx *bolt.Tx, podUUID, id string) error {
+	pods, err := tx.CreateBucketIfNotExists([]byte(podsBucketName))
+	if err != nil {
+		return err
+	}
+	pod, err := pods.CreateBucketIfNotExists([]byte(podUUID))
+	if err != nil {
+		return err
+	}
+	return pod.Put([]byte(id), nil)
+}
+
+// unindexCandidate removes the candidate from the index of the pod within the transaction, dropping
+// the pod from the index along with its last candidate.
+func unindexCandidate(tx *bolt.Tx, podUUID, id string) error {
+	pods := tx.Bucket([]byte(podsBucketName))
+	if pods == nil {
+		return nil
+	}
+	pod := pods.Bucket([]byte(podUUID))
+	if pod == nil {
+		return nil
+	}
+	if err := pod.Delete([]byte(id)); err != nil {
+		return err
+	}
+	if k, _ := pod.Cursor().First(); k == nil {
+		return pods.DeleteBucket([]byte(podUUID))
+	}
+	return nil
+}
+
+// reindexPods rebuilds the pod index from the candidates, which covers candidates queued before the index existed.
+func reindexPods(db *bolt.DB, candidates map[string]*deletionCandidate) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(podsBucketName)) != nil {
+			if err := tx.DeleteBucket([]byte(podsBucketName)); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket([]byte(podsBucketName)); err != nil {
+			return err
+		}
+
+		for id, vol := range candidates {
+			if vol == nil {
+				continue
+			}
+			if err := indexCandidate(tx, vol.podUUID(), id); err != nil {
+				return fmt.Errorf("unable to index %s: %w", id, err)
+			}
+		}
+		return nil
+	})
+}
+
+// idsForPod returns the IDs of every candidate that belonged to the pod.
+func (d *deletedVolumes) idsForPod(podUUID string) []string {
+	var ids []string
+	err := d.storage.View(func(tx *bolt.Tx) error {
+		pods := tx.Bucket([]byte(podsBucketName))
+		if pods == nil {
+			return nil
+		}
+		pod := pods.Bucket([]byte(podUUID))
+		if pod == nil {
+			return nil
+		}
+		return pod.ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		glog.Errorf("unable to look up the volumes of pod %s: %s", podUUID, err)
+	}
+
+	// The index is written along with the candidates, only keep those which made it to memory
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	queued := ids[:0]
+	for _, id := range ids {
+		if vol := d.candidates[id]; vol != nil {
+			queued = append(queued, id)
+		}
+	}
+	sort.Strings(queued)
+	return queued
+}
+
+// removePodDirectory removes the directory which held the candidate once no other candidate of the pod lives in it.
+// Directories still holding anything, such as live volumes of the pod, are left alone.
+func (d *deletedVolumes) removePodDirectory(vol *deletionCandidate) {
+	dir := filepath.Dir(vol.Path)
+	for _, id := range d.idsForPod(vol.podUUID()) {
+		if sibling, found := d.get(id); found && filepath.Dir(sibling.Path) == dir {
+			return
+		}
+	}
+
+	if err := os.Remove(dir); err == nil {
+		glog.V(4).Infof("removed pod directory %s", dir)
+	} else if !os.IsNotExist(err) {
+		glog.V(4).Infof("keeping pod directory %s: %s", dir, err)
+	}
+}
+
+// retain extends the afterlife of the candidates so that they are kept for at least the given duration from now.
+// Every ID must be queued for deletion.
+func (d *deletedVolumes) retain(ids []string, retention time.Duration) ([]*deletionCandidate, error) {
+	if len(ids) == 0 {
+		return nil, errCandidateNotFound
+	}
+
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	until := time.Now().Add(retention)
+	var retained []*deletionCandidate
+	for _, id := range ids {
+		updated, err := d.update(id, func(vol *deletionCandidate) {
+			if lifespan := until.Sub(vol.Time); lifespan > vol.Lifespan {
+				vol.Lifespan = lifespan
+			}
+		})
+		if errors.Is(err, errCandidateNotFound) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to persist retention of %s: %w", id, err)
+		}
+		glog.Infof("retaining %s at %s until at least %s", id, updated.Path, until.Format(time.RFC3339))
+		retained = append(retained, updated)
+	}
+	return retained, nil
+}
+
+// forceDeletePod deletes every candidate of the pod right away. Nothing is deleted when one of them is mounted
+// for inspection or attached to another pod, so that the pod's sandbox is never left half deleted.
+func (d *deletedVolumes) forceDeletePod(podUUID string) ([]string, int64, error) {
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	ids := d.idsForPod(podUUID)
+	if len(ids) == 0 {
+		return nil, 0, fmt.Errorf("pod %s: %w", podUUID, errCandidateNotFound)
+	}
+
+	candidates := make(map[string]*deletionCandidate, len(ids))
+	for _, id := range ids {
+		vol, found := d.get(id)
+		if !found {
+			return nil, 0, fmt.Errorf("%s: %w", id, errCandidateNotFound)
+		}
+		if vol.InspectPath != "" || len(vol.Viewers) > 0 {
+			return nil, 0, fmt.Errorf("%s of pod %s: %w", id, podUUID, errCandidateMounted)
+		}
+		candidates[id] = vol
+	}
+
+	var deleted []string
+	var reclaimed int64
+	var errs []error
+	for _, id := range ids {
+		glog.Infof("forcing deletion of %v at %v along with pod %s", id, candidates[id].Path, podUUID)
+		bytes, err := d.evict(id, candidates[id])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", id, err))
+			continue
+		}
+		deleted = append(deleted, id)
+		reclaimed += bytes
+	}
+	if len(errs) > 0 {
+		return deleted, reclaimed, fmt.Errorf("unable to delete every volume of pod %s: %v", podUUID, errs)
+	}
+	return deleted, reclaimed, nil
+}
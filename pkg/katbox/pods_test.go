@@ -0,0 +1,196 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"k8s.io/mount-utils"
+)
+
+// queuePodVolume queues a volume of the pod created on disk and queued for deletion at the given time.
+func queuePodVolume(t *testing.T, n *node, id, podUUID string, queued time.Time) string {
+	path := fullpath(n.workdir, podUUID, id)
+	require.NoError(t, os.MkdirAll(path, 0750))
+	require.True(t, n.deletedVolumes.queue(id, deletionCandidate{
+		Time:     queued,
+		Lifespan: time.Hour,
+		Path:     path,
+		PodUUID:  podUUID,
+	}))
+	return path
+}
+
+// indexedPods returns the pod index as persisted.
+func indexedPods(t *testing.T, db *bolt.DB) map[string][]string {
+	pods := make(map[string][]string)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(podsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(pod, _ []byte) error {
+			return bucket.Bucket(pod).ForEach(func(id, _ []byte) error {
+				pods[string(pod)] = append(pods[string(pod)], string(id))
+				return nil
+			})
+		})
+	}))
+	return pods
+}
+
+func TestPodIndex(t *testing.T) {
+	n := newTestNode(t)
+	d := &n.deletedVolumes
+
+	queuePodVolume(t, n, "vol1", "pod1", time.Now())
+	queuePodVolume(t, n, "vol2", "pod1", time.Now())
+	queuePodVolume(t, n, "vol3", "pod2", time.Now())
+
+	assert.Equal(t, []string{"vol1", "vol2"}, d.idsForPod("pod1"))
+	assert.Equal(t, []string{"vol3"}, d.idsForPod("pod2"))
+	assert.Empty(t, d.idsForPod("pod3"))
+	assert.Equal(t, map[string][]string{"pod1": {"vol1", "vol2"}, "pod2": {"vol3"}}, indexedPods(t, n.storage))
+
+	// The pod is dropped from the index along with its last volume
+	d.remove("vol3")
+	assert.Equal(t, map[string][]string{"pod1": {"vol1", "vol2"}}, indexedPods(t, n.storage))
+
+	// Candidates queued before the index existed are indexed when loading
+	require.NoError(t, n.storage.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(podsBucketName))
+	}))
+	assert.Empty(t, d.idsForPod("pod1"))
+	require.NoError(t, reindexPods(n.storage, d.candidates))
+	assert.Equal(t, []string{"vol1", "vol2"}, d.idsForPod("pod1"))
+}
+
+func TestPruneEvictsPodsTogether(t *testing.T) {
+	n := newTestNode(t)
+	d := &n.deletedVolumes
+
+	// Only one volume of each pod is due, the others go along with it unless one of them is kept
+	expired := time.Now().Add(-2 * time.Hour)
+	queuePodVolume(t, n, "vol1", "pod1", expired)
+	queuePodVolume(t, n, "vol2", "pod1", time.Now())
+	queuePodVolume(t, n, "vol3", "pod2", expired)
+	queuePodVolume(t, n, "vol4", "pod2", time.Now())
+	queuePodVolume(t, n, "vol5", "pod3", expired)
+	require.NoError(t, d.setPin([]string{"vol4"}, &pin{Owner: "oncall", Reason: "incident"}))
+
+	// Something else than the pod's volumes keeps its directory around
+	require.NoError(t, os.WriteFile(filepath.Join(n.workdir, "pod3", "leftover"), nil, 0600))
+
+	deleted, _ := d.prune(n.workdir, 0)
+	assert.ElementsMatch(t, []string{"vol1", "vol2", "vol5"}, deleted)
+	assert.NoDirExists(t, filepath.Join(n.workdir, "pod1"), "pod directory should go with its last volume")
+	assert.FileExists(t, filepath.Join(n.workdir, "pod3", "leftover"))
+
+	for _, id := range []string{"vol3", "vol4"} {
+		_, queued := d.get(id)
+		assert.True(t, queued, "%s should be kept along with the pinned volume of its pod", id)
+	}
+
+	require.NoError(t, d.setPin([]string{"vol4"}, nil))
+	deleted, _ = d.prune(n.workdir, 0)
+	assert.ElementsMatch(t, []string{"vol3", "vol4"}, deleted)
+	assert.NoDirExists(t, filepath.Join(n.workdir, "pod2"))
+	assert.Empty(t, indexedPods(t, n.storage))
+}
+
+func TestAdminPod(t *testing.T) {
+	n := newTestNode(t)
+	handler := newAdminServer(n, mount.NewFakeMounter(nil)).handler()
+
+	queued := time.Now().Add(-30 * time.Minute)
+	queuePodVolume(t, n, "vol1", "pod1", queued)
+	queuePodVolume(t, n, "vol2", "pod1", queued)
+	queuePodVolume(t, n, "vol3", "pod2", queued)
+
+	rr := adminRequest(t, handler, http.MethodGet, "/v1/pods/pod1", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var candidates []Candidate
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&candidates))
+	require.Len(t, candidates, 2)
+	assert.Equal(t, "vol1", candidates[0].ID)
+	assert.Equal(t, "vol2", candidates[1].ID)
+
+	// Retaining keeps the volumes for at least the given duration from now
+	rr = adminRequest(t, handler, http.MethodPost, "/v1/pods/pod1/retain", RetainRequest{Retention: "24h"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	for _, id := range []string{"vol1", "vol2"} {
+		vol, _ := n.deletedVolumes.get(id)
+		assert.True(t, evictionTime(vol, 1.0).After(time.Now().Add(23*time.Hour)), id)
+	}
+	persisted, err := loadDeletedVolumesFromPersistent(n.storage, deletedVolumesBucketName)
+	require.NoError(t, err)
+	assert.Greater(t, int64(persisted["vol1"].Lifespan), int64(24*time.Hour))
+	vol3, _ := n.deletedVolumes.get("vol3")
+	assert.Equal(t, time.Hour, vol3.Lifespan, "volumes of other pods should be left alone")
+
+	// Retaining never shortens the afterlife
+	rr = adminRequest(t, handler, http.MethodPost, "/v1/candidates/vol1/retain", RetainRequest{Retention: "1m"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	vol1, _ := n.deletedVolumes.get("vol1")
+	assert.Greater(t, int64(vol1.Lifespan), int64(24*time.Hour))
+
+	// Pods with a volume in use are not deleted at all
+	_, err = n.deletedVolumes.setInspectPath("vol2", "/mnt/inspect")
+	require.NoError(t, err)
+	rr = adminRequest(t, handler, http.MethodDelete, "/v1/pods/pod1", nil)
+	assert.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+	assert.DirExists(t, fullpath(n.workdir, "pod1", "vol1"))
+
+	_, err = n.deletedVolumes.setInspectPath("vol2", "")
+	require.NoError(t, err)
+	rr = adminRequest(t, handler, http.MethodDelete, "/v1/pods/pod1", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp DeleteResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, []string{"vol1", "vol2"}, resp.VolumeIDs)
+	assert.NoDirExists(t, filepath.Join(n.workdir, "pod1"))
+	_, stillQueued := n.deletedVolumes.get("vol3")
+	assert.True(t, stillQueued)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"unknownPod", http.MethodGet, "/v1/pods/pod1", nil, http.StatusNotFound},
+		{"unknownVolume", http.MethodPost, "/v1/candidates/vol1/retain", RetainRequest{Retention: "1h"}, http.StatusNotFound},
+		{"invalidRetention", http.MethodPost, "/v1/pods/pod2/retain", RetainRequest{Retention: "forever"}, http.StatusBadRequest},
+		{"negativeRetention", http.MethodPost, "/v1/pods/pod2/retain", RetainRequest{Retention: "-1h"}, http.StatusBadRequest},
+		{"unknownPath", http.MethodGet, "/v1/pods/pod2/volumes", nil, http.StatusNotFound},
+		{"wrongMethod", http.MethodPut, "/v1/pods/pod2", nil, http.StatusMethodNotAllowed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := adminRequest(t, handler, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.code, rr.Code, rr.Body.String())
+		})
+	}
+}
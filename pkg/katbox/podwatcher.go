@@ -0,0 +1,194 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const podUIDIndex = "uid"
+
+// NewKubeClient returns a client for the Kubernetes API using the given kubeconfig file,
+// or the pod's service account when kubeconfig is empty.
+func NewKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load Kubernetes client configuration: %w", err)
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// podWatcher queues the volumes of pods which no longer exist. This happens when the kubelet never
+// gets to unpublish them, for instance when the pod was removed while katbox or the node was down.
+type podWatcher struct {
+	node     *node
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+
+	// suspects holds the pod UUIDs missing from the previous sweep. A pod has to be missing from
+	// two sweeps in a row before its volumes are queued, in case the cache has yet to see a new pod.
+	suspects map[string]bool
+}
+
+func newPodWatcher(client kubernetes.Interface, n *node, nodeName string) *podWatcher {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}))
+
+	w := &podWatcher{
+		node:     n,
+		factory:  factory,
+		informer: factory.Core().V1().Pods().Informer(),
+		suspects: make(map[string]bool),
+	}
+
+	err := w.informer.AddIndexers(cache.Indexers{podUIDIndex: func(obj interface{}) ([]string, error) {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return nil, nil
+		}
+		return []string{string(pod.UID)}, nil
+	}})
+	if err != nil {
+		// Only fails if the informer already started
+		glog.Errorf("unable to index pods by UID: %s", err)
+	}
+
+	w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: w.podDeleted,
+	})
+	return w
+}
+
+// run watches pods until done is closed, sweeping the volumes of missing pods every interval.
+func (w *podWatcher) run(done <-chan struct{}, interval time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	w.factory.Start(done)
+	if !cache.WaitForCacheSync(done, w.informer.HasSynced) {
+		glog.Error("pod watcher stopped before its cache synced")
+		return
+	}
+	glog.Info("pod watcher cache synced")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.sweep()
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *podWatcher) podDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		glog.Warningf("pod watcher received an unexpected object: %T", obj)
+		return
+	}
+
+	w.queuePodVolumes(string(pod.UID), fmt.Sprintf("pod %s/%s was deleted", pod.Namespace, pod.Name))
+}
+
+// podExists reports whether the pod is known to the cache. Pods are assumed to exist until the cache has synced.
+func (w *podWatcher) podExists(podUUID string) bool {
+	if !w.informer.HasSynced() {
+		return true
+	}
+
+	pods, err := w.informer.GetIndexer().ByIndex(podUIDIndex, podUUID)
+	return err != nil || len(pods) > 0
+}
+
+// sweep queues the volumes of pods which have been missing from the cache for two sweeps in a row.
+func (w *podWatcher) sweep() {
+	missing := make(map[string]bool)
+	for _, vol := range w.node.listVolumes() {
+		if vol.PodUUID == "" || missing[vol.PodUUID] {
+			continue
+		}
+
+		pods, err := w.informer.GetIndexer().ByIndex(podUIDIndex, vol.PodUUID)
+		if err != nil {
+			glog.Errorf("unable to look up pod %s: %s", vol.PodUUID, err)
+			continue
+		}
+		if len(pods) == 0 {
+			missing[vol.PodUUID] = true
+		}
+	}
+
+	for podUUID := range missing {
+		if w.suspects[podUUID] {
+			w.queuePodVolumes(podUUID, fmt.Sprintf("pod %s no longer exists", podUUID))
+			delete(missing, podUUID)
+		} else {
+			glog.V(4).Infof("pod %s is missing, its volumes will be queued for deletion if it is still missing on the next sweep", podUUID)
+		}
+	}
+	w.suspects = missing
+}
+
+// queuePodVolumes queues every live volume of the pod for deletion exactly as unpublishing would.
+func (w *podWatcher) queuePodVolumes(podUUID, reason string) {
+	for _, vol := range w.node.listVolumes() {
+		if vol.PodUUID != podUUID {
+			continue
+		}
+
+		if !w.node.locks.tryAcquire(vol.ID) {
+			// The kubelet is unpublishing the volume itself
+			continue
+		}
+
+		// The volume may have been unpublished since it was listed
+		if _, err := w.node.volumeByID(vol.ID); err == nil {
+			glog.Infof("%s, queueing volume %s for deletion", reason, vol.ID)
+			w.node.queueForDeletion(vol.ID, vol)
+		}
+		w.node.locks.release(vol.ID)
+	}
+}
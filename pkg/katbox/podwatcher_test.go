@@ -0,0 +1,137 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testPod(name, uid string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(uid)},
+		Spec:       v1.PodSpec{NodeName: "node"},
+	}
+}
+
+// publishTestVolume adds a live volume to the node as publishing would.
+func publishTestVolume(t *testing.T, n *node, id, podUUID string) {
+	path := fullpath(n.workdir, podUUID, id)
+	require.NoError(t, os.MkdirAll(path, 0750))
+	n.setVolume(volume{ID: id, PodUUID: podUUID, Path: path, Ephemeral: true})
+	persistVolume(t, n, id)
+}
+
+func isQueued(n *node, id string) bool {
+	_, queued := n.deletedVolumes.get(id)
+	return queued
+}
+
+func TestPodWatcherDeletedPod(t *testing.T) {
+	n := newTestNode(t)
+	client := fake.NewSimpleClientset(testPod("pod1", "uid1"), testPod("pod2", "uid2"))
+
+	publishTestVolume(t, n, "vol1", "uid1")
+	publishTestVolume(t, n, "vol2", "uid1")
+	publishTestVolume(t, n, "vol3", "uid2")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go newPodWatcher(client, n, "node").run(done, time.Hour, &wg)
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	// Nothing is queued while pods exist
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, n.listVolumes(), 3)
+
+	require.NoError(t, client.CoreV1().Pods("default").Delete(context.Background(), "pod1", metav1.DeleteOptions{}))
+
+	assert.Eventually(t, func() bool {
+		return isQueued(n, "vol1") && isQueued(n, "vol2")
+	}, 5*time.Second, 10*time.Millisecond, "volumes of the deleted pod should be queued")
+
+	candidate, _ := n.deletedVolumes.get("vol1")
+	assert.Equal(t, fullpath(n.workdir, "uid1", "vol1"), candidate.Path)
+	assert.Equal(t, "uid1", candidate.PodUUID)
+	assert.Equal(t, n.afterLifespan, candidate.Lifespan)
+
+	_, err := n.volumeByID("vol1")
+	assert.Error(t, err, "volume of the deleted pod should no longer be live")
+	persisted, err := loadVolumesFromPersistent(n.storage, volumesBucketName)
+	require.NoError(t, err)
+	assert.NotContains(t, persisted, "vol1")
+
+	_, err = n.volumeByID("vol3")
+	assert.NoError(t, err, "volume of the remaining pod should stay live")
+	assert.False(t, isQueued(n, "vol3"))
+}
+
+func TestPodWatcherSweep(t *testing.T) {
+	n := newTestNode(t)
+	client := fake.NewSimpleClientset(testPod("pod1", "uid1"))
+
+	// uid2 was deleted while katbox was down
+	publishTestVolume(t, n, "vol1", "uid1")
+	publishTestVolume(t, n, "vol2", "uid2")
+
+	w := newPodWatcher(client, n, "node")
+	done := make(chan struct{})
+	defer close(done)
+	w.factory.Start(done)
+	require.True(t, cache.WaitForCacheSync(done, w.informer.HasSynced))
+
+	// A pod has to be missing from two sweeps in a row
+	w.sweep()
+	assert.False(t, isQueued(n, "vol2"))
+	w.sweep()
+	assert.True(t, isQueued(n, "vol2"))
+	assert.False(t, isQueued(n, "vol1"))
+
+	// Pods showing up between sweeps are no longer suspected
+	publishTestVolume(t, n, "vol3", "uid3")
+	w.sweep()
+	_, err := client.CoreV1().Pods("default").Create(context.Background(), testPod("pod3", "uid3"), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		pods, _ := w.informer.GetIndexer().ByIndex(podUIDIndex, "uid3")
+		return len(pods) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	w.sweep()
+	assert.False(t, isQueued(n, "vol3"))
+
+	// Volumes being unpublished by the kubelet are left alone
+	require.NoError(t, client.CoreV1().Pods("default").Delete(context.Background(), "pod1", metav1.DeleteOptions{}))
+	require.True(t, n.locks.tryAcquire("vol1"))
+	w.queuePodVolumes("uid1", "test")
+	assert.False(t, isQueued(n, "vol1"))
+	n.locks.release("vol1")
+}
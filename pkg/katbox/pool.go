@@ -0,0 +1,121 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// defaultPoolName is the name of the pool living in the node's working directory. Volumes
+// which don't ask for a pool, including those created before pools existed, belong to it.
+const defaultPoolName = "default"
+
+// storagePool is a directory volumes are created in, usually on a filesystem of its own.
+type storagePool struct {
+	name          string
+	workdir       string
+	afterLifespan time.Duration
+	quota         *projectQuota
+
+	// headroom is nil when the pool uses the node's headroom.
+	headroom *float64
+}
+
+// poolName returns the name of the pool a volume record belongs to.
+func poolName(name string) string {
+	if name == "" {
+		return defaultPoolName
+	}
+	return name
+}
+
+// newStoragePools creates the working directory of every pool. Pools on the same device share
+// their project quota with each other and with the default pool so project IDs are never reused.
+func newStoragePools(pools []PoolOptions, defaultQuota *projectQuota, afterLifespan time.Duration) (map[string]*storagePool, error) {
+	quotas := make(map[string]*projectQuota)
+	if defaultQuota != nil && defaultQuota.device != "" {
+		quotas[defaultQuota.device] = defaultQuota
+	}
+
+	storagePools := make(map[string]*storagePool)
+	for _, p := range pools {
+		if err := os.MkdirAll(p.Workdir, 0750); err != nil {
+			return nil, fmt.Errorf("failed to create working directory of pool %s: %v", p.Name, err)
+		}
+
+		quota := newProjectQuota(p.Workdir)
+		if shared, ok := quotas[quota.device]; ok && quota.device != "" {
+			quota = shared
+		} else {
+			quotas[quota.device] = quota
+		}
+
+		pool := &storagePool{
+			name:          p.Name,
+			workdir:       p.Workdir,
+			afterLifespan: p.AfterlifeSpan,
+			quota:         quota,
+			headroom:      p.Headroom,
+		}
+		if pool.afterLifespan == 0 {
+			pool.afterLifespan = afterLifespan
+		}
+		storagePools[p.Name] = pool
+	}
+	return storagePools, nil
+}
+
+// pool returns the storage pool with the given name.
+func (n *node) pool(name string) (*storagePool, bool) {
+	if poolName(name) == defaultPoolName {
+		return &storagePool{name: defaultPoolName, workdir: n.workdir, afterLifespan: n.afterLifespan, quota: n.quota}, true
+	}
+
+	p, ok := n.pools[name]
+	return p, ok
+}
+
+// poolOf returns the pool a volume record belongs to. Records of pools which were removed from
+// the configuration fall back to the default pool.
+func (n *node) poolOf(name string) *storagePool {
+	if p, ok := n.pool(name); ok {
+		return p
+	}
+	p, _ := n.pool(defaultPoolName)
+	return p
+}
+
+// listPools returns every pool of the node, starting with the default pool.
+func (n *node) listPools() []*storagePool {
+	pools := []*storagePool{n.poolOf(defaultPoolName)}
+	for _, name := range sortedPoolNames(n.pools) {
+		pools = append(pools, n.pools[name])
+	}
+	return pools
+}
+
+func sortedPoolNames(pools map[string]*storagePool) []string {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
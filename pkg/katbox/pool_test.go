@@ -0,0 +1,213 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// addTestPool adds a pool in a temporary directory to the node.
+func addTestPool(t *testing.T, n *node, name string, headroom *float64, afterLifespan time.Duration) *storagePool {
+	if n.pools == nil {
+		n.pools = make(map[string]*storagePool)
+		n.deletedVolumes.pools = n.pools
+	}
+	p := &storagePool{name: name, workdir: t.TempDir(), afterLifespan: afterLifespan, headroom: headroom}
+	n.pools[name] = p
+	return p
+}
+
+// recordingPolicy evicts nothing and records the candidates and disk state of every pool it's asked about.
+type recordingPolicy struct {
+	candidates [][]string
+	disks      []diskState
+}
+
+func (p *recordingPolicy) victims(now time.Time, candidates map[string]*deletionCandidate, disk diskState) []string {
+	var ids []string
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	p.candidates = append(p.candidates, ids)
+	p.disks = append(p.disks, disk)
+	return nil
+}
+
+func TestPublishIntoPool(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	n := ns.node
+	fast := addTestPool(t, n, "fast", nil, 10*time.Minute)
+	targetDir := t.TempDir()
+
+	req := publishRequest(targetDir, "vol1", "pod1")
+	req.VolumeContext[poolContext] = "fast"
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	require.NoError(t, err)
+
+	vol, err := n.volumeByID("vol1")
+	require.NoError(t, err)
+	assert.Equal(t, "fast", vol.Pool)
+	assert.Equal(t, fullpath(fast.workdir, "pod1", "vol1"), vol.Path)
+	assert.DirExists(t, vol.Path)
+
+	// Volumes which don't ask for a pool stay in the working directory
+	_, err = ns.NodePublishVolume(context.Background(), publishRequest(targetDir, "vol2", "pod1"))
+	require.NoError(t, err)
+	vol, err = n.volumeByID("vol2")
+	require.NoError(t, err)
+	assert.Equal(t, defaultPoolName, poolName(vol.Pool))
+	assert.Equal(t, fullpath(n.workdir, "pod1", "vol2"), vol.Path)
+
+	req = publishRequest(targetDir, "vol3", "pod1")
+	req.VolumeContext[poolContext] = "slow"
+	_, err = ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Unpublished volumes keep the pool's afterlife
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: filepath.Join(targetDir, "vol1"),
+	})
+	require.NoError(t, err)
+	candidate, queued := n.deletedVolumes.get("vol1")
+	require.True(t, queued)
+	assert.Equal(t, "fast", candidate.Pool)
+	assert.Equal(t, fullpath(fast.workdir, "pod1", "vol1"), candidate.Path)
+	assert.Equal(t, 10*time.Minute, candidate.Lifespan)
+}
+
+func TestPrunePerPool(t *testing.T) {
+	n := newTestNode(t)
+	full := 1.0
+	fast := addTestPool(t, n, "fast", &full, time.Hour)
+	addTestPool(t, n, "empty", nil, time.Hour)
+	policy := &recordingPolicy{}
+	n.deletedVolumes.policy = policy
+
+	queue := func(id, pool, workdir string) {
+		path := fullpath(workdir, "pod1", id)
+		require.NoError(t, os.MkdirAll(path, 0750))
+		n.deletedVolumes.queue(id, deletionCandidate{Time: time.Now(), Lifespan: time.Hour, Path: path, Pool: pool})
+	}
+	queue("vol1", "", n.workdir)
+	queue("vol2", "fast", fast.workdir)
+	queue("vol3", "fast", fast.workdir)
+	// Candidates of pools which were removed from the configuration are pruned with the default pool
+	queue("vol4", "removed", n.workdir)
+
+	n.deletedVolumes.prune(n.workdir, 0.0)
+
+	// The default pool comes first, followed by the others in order
+	require.Len(t, policy.candidates, 3)
+	assert.ElementsMatch(t, []string{"vol1", "vol4"}, policy.candidates[0])
+	assert.Empty(t, policy.candidates[1], "empty pool")
+	assert.ElementsMatch(t, []string{"vol2", "vol3"}, policy.candidates[2])
+
+	assert.Equal(t, 0.0, policy.disks[0].headroom)
+	assert.Equal(t, 0.0, policy.disks[1].headroom, "pools without a headroom use the node's")
+	assert.Equal(t, 1.0, policy.disks[2].headroom)
+
+	// No space is ever free enough for a headroom of 1.0
+	assert.Equal(t, 1.0, n.deletedVolumes.lastPressureFactor(""))
+	assert.Less(t, n.deletedVolumes.lastPressureFactor("fast"), 1.0)
+	assert.Equal(t, n.deletedVolumes.lastPressureFactor(""), n.deletedVolumes.lastPressureFactor("removed"))
+}
+
+func TestReconcilePools(t *testing.T) {
+	n := newTestNode(t)
+	fast := addTestPool(t, n, "fast", nil, 10*time.Minute)
+
+	orphanPath := fullpath(fast.workdir, "pod1", "orphan")
+	require.NoError(t, os.MkdirAll(orphanPath, 0750))
+
+	n.reconcile(nil)
+
+	candidate, queued := n.deletedVolumes.get("orphan")
+	require.True(t, queued, "orphans of pools should be adopted")
+	assert.Equal(t, "fast", candidate.Pool)
+	assert.Equal(t, orphanPath, candidate.Path)
+	assert.Equal(t, 10*time.Minute, candidate.Lifespan)
+}
+
+func TestValidatePools(t *testing.T) {
+	workdir := t.TempDir()
+	half, tooMuch := 0.5, 1.5
+	tests := []struct {
+		name  string
+		pools []PoolOptions
+		err   string
+	}{
+		{"valid", []PoolOptions{{Name: "fast", Workdir: "/mnt/fast", Headroom: &half}, {Name: "slow", Workdir: "/mnt/slow"}}, ""},
+		{"missing workdir", []PoolOptions{{Name: "fast"}}, "every pool needs a name and a working directory"},
+		{"default name", []PoolOptions{{Name: defaultPoolName, Workdir: "/mnt/fast"}}, "defined more than once"},
+		{"duplicate name", []PoolOptions{{Name: "fast", Workdir: "/mnt/a"}, {Name: "fast", Workdir: "/mnt/b"}}, "defined more than once"},
+		{"same workdir", []PoolOptions{{Name: "fast", Workdir: workdir + "/"}}, "overlaps"},
+		{"nested workdir", []PoolOptions{{Name: "fast", Workdir: filepath.Join(workdir, "fast")}}, "overlaps"},
+		{"nested pools", []PoolOptions{{Name: "a", Workdir: "/mnt/a/b"}, {Name: "b", Workdir: "/mnt/a"}}, "overlaps"},
+		{"sibling prefix", []PoolOptions{{Name: "a", Workdir: "/mnt/a"}, {Name: "b", Workdir: "/mnt/ab"}}, ""},
+		{"headroom above 1", []PoolOptions{{Name: "fast", Workdir: "/mnt/fast", Headroom: &tooMuch}}, "headroom of pool fast"},
+		{"negative afterlife", []PoolOptions{{Name: "fast", Workdir: "/mnt/fast", AfterlifeSpan: -time.Hour}}, "afterlife span of pool fast"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePools(workdir, tt.pools)
+			if tt.err == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestNewStoragePools(t *testing.T) {
+	dir := t.TempDir()
+	pools, err := newStoragePools([]PoolOptions{
+		{Name: "fast", Workdir: filepath.Join(dir, "fast"), AfterlifeSpan: time.Minute},
+		{Name: "slow", Workdir: filepath.Join(dir, "slow")},
+	}, nil, time.Hour)
+	require.NoError(t, err)
+
+	require.Len(t, pools, 2)
+	assert.DirExists(t, pools["fast"].workdir)
+	assert.Equal(t, time.Minute, pools["fast"].afterLifespan)
+	assert.Equal(t, time.Hour, pools["slow"].afterLifespan, "pools without an afterlife use the node's")
+}
+
+func TestLifespan(t *testing.T) {
+	n := newTestNode(t)
+	n.maxLifespan = 2 * time.Hour
+	addTestPool(t, n, "fast", nil, time.Minute)
+
+	zero, day := time.Duration(0), 24*time.Hour
+	assert.Equal(t, time.Hour, n.lifespan(volume{}), "volumes without a retention use the node's afterlife")
+	assert.Equal(t, time.Minute, n.lifespan(volume{Pool: "fast"}), "volumes without a retention use their pool's afterlife")
+	assert.Equal(t, time.Duration(0), n.lifespan(volume{Pool: "fast", Retention: &zero}), "an explicit zero retention should be kept")
+	assert.Equal(t, 2*time.Hour, n.lifespan(volume{Retention: &day}), "retention should be clamped to the node's bounds")
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names accepted by newPressureCurve besides a list of steps
+const (
+	linearPressure      = "linear"
+	exponentialPressure = "exponential"
+)
+
+// exponentialSteepness shapes the exponential curve: the higher it is, the longer the afterlife is spared
+// while free space sinks into the headroom and the faster it shrinks once the headroom is nearly used up.
+const exponentialSteepness = 3.0
+
+// pressureCurve maps the utilization of a filesystem to the factor applied to the afterlife of deletion candidates.
+type pressureCurve interface {
+	// factor returns a value between 0 and 1 given the total and free amount of a resource and its headroom.
+	factor(total, free uint64, headroom float64) (float64, error)
+}
+
+func newPressureCurve(spec string) (pressureCurve, error) {
+	switch strings.TrimSpace(spec) {
+	case linearPressure, "":
+		return linearCurve{}, nil
+	case exponentialPressure:
+		return exponentialCurve{}, nil
+	default:
+		return parsePressureSteps(spec)
+	}
+}
+
+// linearCurve shrinks the afterlife in proportion to how far free space has sunk into the headroom.
+type linearCurve struct{}
+
+func (linearCurve) factor(total, free uint64, headroom float64) (float64, error) {
+	return pressureFactor(total, free, headroom)
+}
+
+// exponentialCurve barely shrinks the afterlife while free space starts sinking into the headroom
+// and shrinks it faster and faster as the headroom runs out.
+type exponentialCurve struct{}
+
+func (exponentialCurve) factor(total, free uint64, headroom float64) (float64, error) {
+	linear, err := pressureFactor(total, free, headroom)
+	if err != nil {
+		return 0, err
+	}
+
+	used := 1.0 - linear
+	return 1.0 - math.Expm1(exponentialSteepness*used)/math.Expm1(exponentialSteepness), nil
+}
+
+// pressureStep applies factor once the share of the resource in use reaches usage.
+type pressureStep struct {
+	usage  float64
+	factor float64
+}
+
+// stepCurve applies the factor of the highest step reached by the utilization of the filesystem,
+// regardless of the headroom. Below the first step the afterlife is left untouched, and so it is when the
+// headroom is zero, which leaves the resource out as it does with the other curves.
+type stepCurve []pressureStep
+
+func (s stepCurve) factor(total, free uint64, headroom float64) (float64, error) {
+	if headroom < 0.0 || headroom > 1.0 {
+		return 0, errors.New("headroom must be a value between 0 and 1.0 (inclusive)")
+	}
+	if headroom == 0 || total == 0 || free >= total {
+		return 1.0, nil
+	}
+
+	usage := 1.0 - float64(free)/float64(total)
+	factor := 1.0
+	for _, step := range s {
+		if usage < step.usage {
+			break
+		}
+		factor = step.factor
+	}
+	return factor, nil
+}
+
+// parsePressureSteps parses a comma separated list of steps such as "85%=0.5, 95%=0.1", where each step maps
+// the share of the filesystem in use to the factor applied once it is reached. "->" and "→" may be used
+// instead of "=" and the usage may also be written as a fraction.
+func parsePressureSteps(spec string) (stepCurve, error) {
+	var steps stepCurve
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.NewReplacer("→", "=", "->", "=").Replace(field)
+		parts := strings.Split(field, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf(
+				"unknown pressure curve %q, must be %s, %s or a list of steps such as \"85%%=0.5, 95%%=0.1\"",
+				spec, linearPressure, exponentialPressure)
+		}
+
+		usage, err := parseShare(parts[0])
+		if err != nil || usage <= 0 || usage > 1.0 {
+			return nil, fmt.Errorf("usage of pressure step %q must be a percentage above 0%% and up to 100%%", field)
+		}
+		factor, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || factor < 0 || factor > 1.0 {
+			return nil, fmt.Errorf("factor of pressure step %q must be a value between 0 and 1.0 (inclusive)", field)
+		}
+		steps = append(steps, pressureStep{usage: usage, factor: factor})
+	}
+
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].usage < steps[j].usage
+	})
+	for i := 1; i < len(steps); i++ {
+		if steps[i].usage == steps[i-1].usage {
+			return nil, fmt.Errorf("pressure steps %q define usage %v more than once", spec, steps[i].usage)
+		}
+		if steps[i].factor > steps[i-1].factor {
+			return nil, fmt.Errorf("pressure steps %q must not relax the factor as usage grows", spec)
+		}
+	}
+	return steps, nil
+}
+
+// parseShare parses a percentage such as "85%" or a fraction such as "0.85".
+func parseShare(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		return percent / 100, err
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// pressureFloor keeps the pressure factor from dropping below floor for as long as the share of free space
+// and of free inodes stays above criticalHeadroom.
+type pressureFloor struct {
+	floor            float64
+	criticalHeadroom float64
+}
+
+// apply returns the factor raised to the floor unless the filesystem is critically full.
+func (p pressureFloor) apply(factor float64, usage filesystemUsage) float64 {
+	if factor >= p.floor || p.critical(usage) {
+		return factor
+	}
+	return p.floor
+}
+
+func (p pressureFloor) critical(usage filesystemUsage) bool {
+	if shortfall(usage.total, usage.free, p.criticalHeadroom) > 0 {
+		return true
+	}
+	return usage.inodes > 0 && shortfall(usage.inodes, usage.freeInodes, p.criticalHeadroom) > 0
+}
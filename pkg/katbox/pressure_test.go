@@ -0,0 +1,171 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pressureCurve(t *testing.T) {
+	steps := stepCurve{{usage: .85, factor: .5}, {usage: .95, factor: .1}}
+	tests := []struct {
+		name           string
+		curve          pressureCurve
+		free           uint64
+		headroom       float64
+		expectedFactor float64
+		expectErr      bool
+	}{
+		{"linearUnderUsage", linearCurve{}, 110, .10, 1.0, false},
+		{"linearHalfway", linearCurve{}, 50, .10, .5, false},
+		{"linearFull", linearCurve{}, 0, .10, 0.0, false},
+		{"exponentialUnderUsage", exponentialCurve{}, 110, .10, 1.0, false},
+		{"exponentialEarly", exponentialCurve{}, 90, .10, .9817, false},
+		{"exponentialHalfway", exponentialCurve{}, 50, .10, .8176, false},
+		{"exponentialLate", exponentialCurve{}, 10, .10, .2727, false},
+		{"exponentialFull", exponentialCurve{}, 0, .10, 0.0, false},
+		{"exponentialInvalidHeadroom", exponentialCurve{}, 50, 10, 0.0, true},
+		{"stepsBelowFirst", steps, 200, .10, 1.0, false},
+		{"stepsFirst", steps, 140, .10, .5, false},
+		{"stepsBetween", steps, 100, .10, .5, false},
+		{"stepsLast", steps, 40, .10, .1, false},
+		{"stepsFull", steps, 0, .10, .1, false},
+		{"stepsDisabled", steps, 0, 0, 1.0, false},
+		{"stepsInvalidHeadroom", steps, 100, -.10, 0.0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pf, err := tt.curve.factor(1000, tt.free, tt.headroom)
+
+			if tt.expectErr {
+				assert.Error(t, err, "expected an error")
+			} else {
+				assert.NoError(t, err, "unexpected error")
+				assert.InDelta(t, tt.expectedFactor, pf, 1e-4, "Incorrect pressure factor")
+			}
+		})
+	}
+}
+
+func Test_newPressureCurve(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		expected pressureCurve
+		err      string
+	}{
+		{"default", "", linearCurve{}, ""},
+		{"linear", "linear", linearCurve{}, ""},
+		{"exponential", "exponential", exponentialCurve{}, ""},
+		{"steps", "85%=0.5, 95%=0.1", stepCurve{{.85, .5}, {.95, .1}}, ""},
+		{"arrows", "85%→0.5, 95%->0.1", stepCurve{{.85, .5}, {.95, .1}}, ""},
+		{"fractionsOutOfOrder", "0.95=0.1,0.85=0.5", stepCurve{{.85, .5}, {.95, .1}}, ""},
+		{"unknown", "quadratic", nil, "unknown pressure curve"},
+		{"usageAbove100", "120%=0.5", nil, "usage of pressure step"},
+		{"zeroUsage", "0%=0.5", nil, "usage of pressure step"},
+		{"invalidUsage", "most=0.5", nil, "usage of pressure step"},
+		{"factorAbove1", "85%=2", nil, "factor of pressure step"},
+		{"duplicateUsage", "85%=0.5, 0.85=0.4", nil, "more than once"},
+		{"relaxing", "85%=0.1, 95%=0.5", nil, "must not relax the factor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			curve, err := newPressureCurve(tt.spec)
+
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, curve)
+			}
+		})
+	}
+}
+
+func Test_pressureFloor(t *testing.T) {
+	floor := pressureFloor{floor: .3, criticalHeadroom: .02}
+	tests := []struct {
+		name           string
+		floor          pressureFloor
+		factor         float64
+		free           uint64
+		freeInodes     uint64
+		expectedFactor float64
+	}{
+		{"aboveFloor", floor, .5, 50, 500, .5},
+		{"raisedToFloor", floor, .1, 30, 500, .3},
+		{"criticallyFull", floor, .1, 10, 500, .1},
+		{"criticallyShortOfInodes", floor, .1, 30, 10, .1},
+		{"noFloor", pressureFloor{criticalHeadroom: .02}, 0, 30, 500, 0},
+		{"noCriticalHeadroom", pressureFloor{floor: .3}, 0, 0, 0, .3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := filesystemUsage{total: 1000, free: tt.free, inodes: 1000, freeInodes: tt.freeInodes}
+			assert.Equal(t, tt.expectedFactor, tt.floor.apply(tt.factor, usage), "Incorrect pressure factor")
+		})
+	}
+}
+
+func TestPruneWithPressureSteps(t *testing.T) {
+	n := newTestNode(t)
+	d := &n.deletedVolumes
+	d.curve = stepCurve{{usage: .85, factor: .5}, {usage: .95, factor: .1}}
+	d.floor = pressureFloor{floor: .2, criticalHeadroom: .02}
+
+	// 96% used, the last step applies but the floor holds the factor at 20% of an hour
+	d.statFilesystem = fixedFilesystem(4000)
+	queueSized(t, n, "old", time.Now().Add(-15*time.Minute), 10)
+	queueSized(t, n, "recent", time.Now().Add(-8*time.Minute), 10)
+
+	deleted, _ := d.prune(n.workdir, 0.1)
+	assert.Equal(t, []string{"old"}, deleted)
+	assert.Equal(t, .2, d.lastPressureFactor(defaultPoolName))
+
+	// Once critically full the floor no longer holds
+	d.statFilesystem = fixedFilesystem(1000)
+	deleted, _ = d.prune(n.workdir, 0.1)
+	assert.Equal(t, []string{"recent"}, deleted)
+	assert.Equal(t, .1, d.lastPressureFactor(defaultPoolName))
+}
+
+func TestPruneWithPressureStepsAboveHeadroom(t *testing.T) {
+	n := newTestNode(t)
+	d := &n.deletedVolumes
+
+	// 87% used, free space is still above the 10% headroom but the first step halves the afterlife
+	d.statFilesystem = fixedFilesystem(13000)
+	queueSized(t, n, "old", time.Now().Add(-40*time.Minute), 10)
+	queueSized(t, n, "recent", time.Now().Add(-20*time.Minute), 10)
+
+	// The linear curve leaves the afterlife alone until the headroom is reached
+	deleted, _ := d.prune(n.workdir, 0.1)
+	assert.Empty(t, deleted)
+	assert.Equal(t, 1.0, d.lastPressureFactor(defaultPoolName))
+
+	d.curve = stepCurve{{usage: .85, factor: .5}}
+	deleted, _ = d.prune(n.workdir, 0.1)
+	assert.Equal(t, []string{"old"}, deleted)
+	assert.Equal(t, .5, d.lastPressureFactor(defaultPoolName))
+	_, queued := d.get("recent")
+	assert.True(t, queued, "candidates within the shortened afterlife should be kept")
+}
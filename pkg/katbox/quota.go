@@ -0,0 +1,326 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+
+	"k8s.io/mount-utils"
+)
+
+// Project IDs handed out by katbox. The range is kept well away from the low IDs commonly
+// assigned by hand through /etc/projects and from the range used by the kubelet.
+const (
+	projectIDBase uint32 = 1 << 24
+	projectIDMax  uint32 = projectIDBase + 1<<20
+)
+
+// Values taken from linux/quota.h and linux/fs.h as they are not exposed by x/sys/unix.
+const (
+	prjQuota           = 2
+	qGetInfo           = 0x800005
+	qSetQuota          = 0x800008
+	qifBLimits         = 1
+	qifILimits         = 4
+	quotaBlockSize     = 1024
+	fsIocFsGetXattr    = 0x801c581f
+	fsIocFsSetXattr    = 0x401c5820
+	fsXflagProjInherit = 0x00000200
+)
+
+// ifDqblk mirrors struct if_dqblk from linux/quota.h.
+type ifDqblk struct {
+	bHardLimit uint64
+	bSoftLimit uint64
+	curSpace   uint64
+	iHardLimit uint64
+	iSoftLimit uint64
+	curInodes  uint64
+	bTime      uint64
+	iTime      uint64
+	valid      uint32
+}
+
+// ifDqinfo mirrors struct if_dqinfo from linux/quota.h.
+type ifDqinfo struct {
+	bGrace uint64
+	iGrace uint64
+	flags  uint32
+	valid  uint32
+}
+
+// fsxattr mirrors struct fsxattr from linux/fs.h.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// projectQuota enforces per volume size limits using XFS or ext4 project quotas on the
+// filesystem backing the working directory.
+type projectQuota struct {
+	device    string
+	supported bool
+	inUse     map[uint32]struct{}
+	lock      sync.Mutex
+}
+
+// newProjectQuota determines whether the filesystem holding workdir has project quotas enabled.
+// An unsupported projectQuota is always returned on failure so callers can fall back to soft limits.
+func newProjectQuota(workdir string) *projectQuota {
+	device, fsType, err := backingDevice(workdir)
+	if err != nil {
+		glog.Warningf("unable to determine device backing %s, project quotas disabled: %v", workdir, err)
+		return &projectQuota{inUse: make(map[uint32]struct{})}
+	}
+
+	if fsType != "xfs" && fsType != "ext4" {
+		glog.Infof("filesystem %s backing %s does not support project quotas, using soft limits", fsType, workdir)
+		return &projectQuota{device: device, inUse: make(map[uint32]struct{})}
+	}
+
+	var info ifDqinfo
+	if err := quotactl(qGetInfo, device, 0, unsafe.Pointer(&info)); err != nil {
+		glog.Infof("project quotas are not enabled on %s, using soft limits: %v", device, err)
+		return &projectQuota{device: device, inUse: make(map[uint32]struct{})}
+	}
+
+	glog.Infof("enforcing volume sizes using project quotas on %s", device)
+	return &projectQuota{device: device, supported: true, inUse: make(map[uint32]struct{})}
+}
+
+// enabled reports whether limits are enforced by the filesystem.
+func (q *projectQuota) enabled() bool {
+	return q != nil && q.supported
+}
+
+// reserve marks a project ID loaded from persistent storage as taken.
+func (q *projectQuota) reserve(id uint32) {
+	if q == nil || id == 0 {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.inUse[id] = struct{}{}
+}
+
+// adopt reserves the project ID the directory of a volume found without a record is tagged with, so that it isn't
+// handed to another volume before the directory is deleted. It returns zero when the directory has no project ID of
+// katbox's range or when that ID is already held by another volume.
+func (q *projectQuota) adopt(path string) uint32 {
+	if !q.enabled() {
+		return 0
+	}
+
+	id, err := projectIDOf(path)
+	if err != nil {
+		glog.Warningf("unable to read the project ID of %s: %s", path, err)
+		return 0
+	}
+	if id < projectIDBase || id >= projectIDMax {
+		return 0
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, taken := q.inUse[id]; taken {
+		return 0
+	}
+	q.inUse[id] = struct{}{}
+	return id
+}
+
+// assign allocates a project ID, tags the directory with it so that new files and directories
+// inherit it, and sets a hard limit on the number of bytes and inodes that project can consume.
+// A limit of zero leaves that resource unbounded.
+func (q *projectQuota) assign(path string, bytes, inodes int64) (uint32, error) {
+	if !q.enabled() {
+		return 0, errors.New("project quotas are not supported")
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	id, err := q.allocate()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setProjectID(path, id); err != nil {
+		return 0, fmt.Errorf("unable to set project ID %d on %s: %w", id, path, err)
+	}
+
+	if err := q.setLimits(id, bytes, inodes); err != nil {
+		return 0, fmt.Errorf("unable to set quota for project %d: %w", id, err)
+	}
+
+	q.inUse[id] = struct{}{}
+	return id, nil
+}
+
+// release clears the limits set for a project ID so it may be handed out again.
+func (q *projectQuota) release(id uint32) error {
+	if !q.enabled() || id == 0 {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.setLimits(id, 0, 0); err != nil {
+		return fmt.Errorf("unable to clear quota for project %d: %w", id, err)
+	}
+
+	delete(q.inUse, id)
+	return nil
+}
+
+// resize changes the limits of a project ID handed out by assign.
+func (q *projectQuota) resize(id uint32, bytes, inodes int64) error {
+	if !q.enabled() || id == 0 {
+		return errors.New("volume has no project quota")
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err := q.setLimits(id, bytes, inodes); err != nil {
+		return fmt.Errorf("unable to resize quota for project %d: %w", id, err)
+	}
+	return nil
+}
+
+// allocate returns the lowest project ID in katbox's range that is not in use.
+// Must be called with the lock held.
+func (q *projectQuota) allocate() (uint32, error) {
+	for id := projectIDBase; id < projectIDMax; id++ {
+		if _, found := q.inUse[id]; !found {
+			return id, nil
+		}
+	}
+	return 0, errors.New("no project IDs left to allocate")
+}
+
+func (q *projectQuota) setLimits(id uint32, bytes, inodes int64) error {
+	dq := ifDqblk{
+		bHardLimit: uint64((bytes + quotaBlockSize - 1) / quotaBlockSize),
+		iHardLimit: uint64(inodes),
+		valid:      qifBLimits | qifILimits,
+	}
+	return quotactl(qSetQuota, q.device, id, unsafe.Pointer(&dq))
+}
+
+func quotactl(cmd int, device string, id uint32, addr unsafe.Pointer) error {
+	special, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := unix.Syscall6(
+		unix.SYS_QUOTACTL,
+		uintptr(cmd<<8|prjQuota),
+		uintptr(unsafe.Pointer(special)),
+		uintptr(id),
+		uintptr(addr),
+		0,
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func projectIDOf(path string) (uint32, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+
+	var attr fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return 0, errno
+	}
+	return attr.projid, nil
+}
+
+func setProjectID(path string, id uint32) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	var attr fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errno
+	}
+
+	attr.projid = id
+	attr.xflags |= fsXflagProjInherit
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// backingDevice returns the source device and filesystem type of the mount point holding path.
+func backingDevice(path string) (string, string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	mounts, err := mount.ParseMountInfo("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
+
+	var best *mount.MountInfo
+	for i := range mounts {
+		mp := mounts[i].MountPoint
+		if resolved != mp && !strings.HasPrefix(resolved, strings.TrimSuffix(mp, "/")+"/") {
+			continue
+		}
+		if best == nil || len(mp) >= len(best.MountPoint) {
+			best = &mounts[i]
+		}
+	}
+
+	if best == nil {
+		return "", "", fmt.Errorf("no mount point found for %s", resolved)
+	}
+
+	return best.Source, best.FsType, nil
+}
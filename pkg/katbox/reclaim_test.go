@@ -0,0 +1,176 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixedFilesystem reports a 100000 byte filesystem with the given amount of free space and plenty of inodes.
+func fixedFilesystem(free uint64) func(string) filesystemUsage {
+	return func(string) filesystemUsage {
+		return filesystemUsage{total: 100000, free: free, inodes: 1000, freeInodes: 1000}
+	}
+}
+
+// queueSized queues a candidate of its own pod whose size was already measured.
+func queueSized(t *testing.T, n *node, id string, queued time.Time, size int64) {
+	path := fullpath(n.workdir, "pod-"+id, id)
+	require.NoError(t, os.MkdirAll(path, 0750))
+	require.True(t, n.deletedVolumes.queue(id, deletionCandidate{
+		Time:     queued,
+		Lifespan: time.Hour,
+		Path:     path,
+		PodUUID:  "pod-" + id,
+		Size:     size,
+		SizedAt:  time.Now(),
+	}))
+}
+
+func TestQueueMeasuresSize(t *testing.T) {
+	n := newTestNode(t)
+	path := fullpath(n.workdir, "pod1", "vol1")
+	require.NoError(t, os.MkdirAll(path, 0750))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "data"), make([]byte, 64*1024), 0600))
+
+	require.True(t, n.deletedVolumes.queue("vol1", deletionCandidate{Time: time.Now(), Lifespan: time.Hour, Path: path}))
+
+	persisted, err := loadDeletedVolumesFromPersistent(n.storage, deletedVolumesBucketName)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, persisted["vol1"].Size, int64(64*1024))
+	assert.False(t, persisted["vol1"].SizedAt.IsZero())
+}
+
+func TestPruneReclaimsOnlyWhatIsNeeded(t *testing.T) {
+	n := newTestNode(t)
+	d := &n.deletedVolumes
+
+	// 6000 bytes short of the 10000 byte headroom, shortening afterlives to 40% of an hour
+	d.statFilesystem = fixedFilesystem(4000)
+
+	now := time.Now()
+	queueSized(t, n, "expired", now.Add(-2*time.Hour), 1000)
+	queueSized(t, n, "oldest", now.Add(-50*time.Minute), 4000)
+	queueSized(t, n, "older", now.Add(-40*time.Minute), 4000)
+	queueSized(t, n, "old", now.Add(-30*time.Minute), 4000)
+	queueSized(t, n, "recent", now.Add(-10*time.Minute), 4000)
+
+	deleted, reclaimed := d.prune(n.workdir, 0.1)
+	assert.Equal(t, []string{"expired", "oldest", "older"}, deleted)
+	assert.Equal(t, int64(9000), reclaimed)
+	assert.Equal(t, poolReclaim{target: 6000, reclaimed: 9000}, d.lastPoolReclaim(defaultPoolName))
+
+	_, queued := d.get("old")
+	assert.True(t, queued, "eligible volumes should be kept once enough space is reclaimed")
+
+	// Without pressure only expired volumes go
+	d.statFilesystem = fixedFilesystem(50000)
+	deleted, reclaimed = d.prune(n.workdir, 0.1)
+	assert.Empty(t, deleted)
+	assert.Zero(t, reclaimed)
+	assert.Equal(t, poolReclaim{}, d.lastPoolReclaim(defaultPoolName))
+}
+
+func TestPruneRefreshesStaleSizes(t *testing.T) {
+	n := newTestNode(t)
+	d := &n.deletedVolumes
+
+	queueSized(t, n, "vol1", time.Now(), 1)
+	vol, _ := d.get("vol1")
+	require.NoError(t, os.WriteFile(filepath.Join(vol.Path, "data"), make([]byte, 64*1024), 0600))
+	stale := *vol
+	stale.SizedAt = time.Now().Add(-2 * sizeRefreshInterval)
+	require.NoError(t, d.replace("vol1", stale))
+
+	// Sizes are only measured again when the pool is short of space
+	d.statFilesystem = fixedFilesystem(50000)
+	d.prune(n.workdir, 0.1)
+	vol, _ = d.get("vol1")
+	assert.Equal(t, int64(1), vol.Size)
+
+	d.statFilesystem = fixedFilesystem(9999)
+	deleted, _ := d.prune(n.workdir, 0.1)
+	assert.Empty(t, deleted)
+
+	vol, _ = d.get("vol1")
+	assert.GreaterOrEqual(t, vol.Size, int64(64*1024))
+	persisted, err := loadDeletedVolumesFromPersistent(n.storage, deletedVolumesBucketName)
+	require.NoError(t, err)
+	assert.Equal(t, vol.Size, persisted["vol1"].Size)
+}
+
+func Test_poolDisk(t *testing.T) {
+	tests := []struct {
+		name           string
+		free           uint64
+		inodes         uint64
+		freeInodes     uint64
+		headroom       float64
+		inodeHeadroom  float64
+		expectedFactor float64
+	}{
+		{"noPressure", 110, 1000, 110, .10, .10, 1.0},
+		{"bytePressure", 99, 1000, 110, .10, .10, .99},
+		{"inodePressure", 110, 1000, 50, .10, .10, .5},
+		{"bothUseLowest", 60, 1000, 80, .10, .10, .6},
+		{"inodesDisabled", 110, 1000, 0, .10, 0, 1.0},
+		{"noInodesReported", 110, 0, 0, .10, .10, 1.0},
+		{"invalidInodeHeadroom", 110, 1000, 110, .10, 10, .1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := filesystemUsage{total: 1000, free: tt.free, inodes: tt.inodes, freeInodes: tt.freeInodes}
+			disk := (&deletedVolumes{}).poolDisk(tt.name, usage, tt.headroom, tt.inodeHeadroom)
+			assert.InDelta(t, tt.expectedFactor, disk.pressureFactor, 1e-9, "Incorrect pressure factor")
+		})
+	}
+}
+
+func TestPruneInodePressure(t *testing.T) {
+	n := newTestNode(t)
+	d := &n.deletedVolumes
+	d.settings.set(time.Minute, 0.1, 0.1)
+
+	// Plenty of space but 60 inodes short of the 100 inode headroom, shortening afterlives to 40% of an hour
+	d.statFilesystem = func(string) filesystemUsage {
+		return filesystemUsage{total: 100000, free: 50000, inodes: 1000, freeInodes: 40}
+	}
+
+	now := time.Now()
+	for id, queued := range map[string]time.Time{
+		"oldest": now.Add(-50 * time.Minute),
+		"older":  now.Add(-40 * time.Minute),
+		"old":    now.Add(-30 * time.Minute),
+	} {
+		queueSized(t, n, id, queued, 10)
+		vol, _ := d.get(id)
+		withInodes := *vol
+		withInodes.Inodes = 40
+		require.NoError(t, d.replace(id, withInodes))
+	}
+
+	deleted, _ := d.prune(n.workdir, 0.1)
+	assert.Equal(t, []string{"oldest", "older"}, deleted)
+	assert.Equal(t, poolReclaim{reclaimed: 20, inodeTarget: 60, reclaimedInodes: 80}, d.lastPoolReclaim(defaultPoolName))
+	assert.InDelta(t, 0.4, d.lastPressureFactor(defaultPoolName), 1e-9)
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/mount-utils"
+)
+
+const procMountInfo = "/proc/self/mountinfo"
+
+// Kinds of corrections made by reconciliation
+const (
+	// A volume record whose target path is no longer mounted, the volume was unpublished while the plugin was down.
+	unmountedVolume = "unmounted_volume"
+	// A deletion candidate whose volume is still mounted.
+	mountedCandidate = "mounted_candidate"
+	// A deletion candidate whose directory no longer exists.
+	missingCandidate = "missing_candidate"
+	// A volume directory in the working directory without any record.
+	orphanVolume = "orphan_volume"
+	// A pod directory in the working directory without any volume.
+	emptyPodDirectory = "empty_pod_directory"
+	// A volume directory left half prepared by a plugin that stopped while creating it.
+	stagingVolume = "staging_volume"
+)
+
+// emptyPodDirectoryGracePeriod keeps reconciliation from removing pod directories that are being published into.
+const emptyPodDirectoryGracePeriod = time.Minute
+
+// periodicReconcile periodically checks the node's records against the working directory and the mounts.
+func (n *node) periodicReconcile(done <-chan struct{}, interval time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n.reconcile(procMounts)
+		}
+	}
+}
+
+// procMounts returns the set of paths currently mounted in the plugin's mount namespace.
+func procMounts() map[string]bool {
+	return mountPoints(procMountInfo)
+}
+
+// mountPoints returns the set of paths that are mount points according to the given mountinfo file.
+// It returns nil if the file cannot be read.
+func mountPoints(mountInfoPath string) map[string]bool {
+	infos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		glog.Warningf("unable to read mount points from %s: %s", mountInfoPath, err)
+		return nil
+	}
+
+	paths := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		paths[info.MountPoint] = true
+	}
+	return paths
+}
+
+// reconcile brings the volume records and the deletion queue back in line with the working directory
+// and the mount points, which drift apart when the plugin is down while the kubelet tears down pods or
+// when it crashes halfway through an operation. Mount checks are skipped when mounts is nil or returns nil.
+func (n *node) reconcile(mounts func() map[string]bool) {
+	start := time.Now()
+	corrections := 0
+	correct := func(kind, format string, args ...interface{}) {
+		glog.Warningf("reconciliation: "+format, args...)
+		reconcileCorrections.WithLabelValues(kind).Inc()
+		corrections++
+	}
+
+	var mounted map[string]bool
+	if mounts != nil {
+		mounted = mounts()
+	}
+	if mounted != nil {
+		for _, vol := range n.listVolumes() {
+			if !n.locks.tryAcquire(vol.ID) {
+				continue
+			}
+			n.reconcileMount(vol.ID, mounted, mounts, correct)
+			n.locks.release(vol.ID)
+		}
+	}
+
+	// The queue is corrected between prune rounds, which would otherwise evict or persist what is removed here
+	n.deletedVolumes.pruneLock.Lock()
+
+	n.deletedVolumes.lock.RLock()
+	candidates := make(map[string]deletionCandidate, len(n.deletedVolumes.candidates))
+	for id, vol := range n.deletedVolumes.candidates {
+		if vol != nil {
+			candidates[id] = *vol
+		}
+	}
+	n.deletedVolumes.lock.RUnlock()
+
+	for id, vol := range candidates {
+		if _, err := os.Stat(vol.Path); os.IsNotExist(err) {
+			correct(missingCandidate, "%s at %s no longer exists, removing it from the deletion queue", id, vol.Path)
+			vol := vol
+			n.deletedVolumes.drop(id, &vol)
+		}
+	}
+	n.deletedVolumes.pruneLock.Unlock()
+
+	for _, pool := range n.listPools() {
+		n.reconcilePool(pool, correct)
+	}
+
+	glog.Infof("reconciliation made %d corrections in %s", corrections, time.Since(start))
+}
+
+// reconcileMount checks the volume against the mount points, the caller must hold the volume's lock.
+// The snapshot of mount points predates the volume list, so the volume may have been published or
+// unpublished since: the current record is used and the mount points are read again before correcting it.
+func (n *node) reconcileMount(id string, mounted map[string]bool, mounts func() map[string]bool,
+	correct func(kind, format string, args ...interface{})) {
+	vol, err := n.volumeByID(id)
+	// Records written before target paths were kept can't be checked
+	if err != nil || vol.TargetPath == "" {
+		return
+	}
+
+	_, queued := n.deletedVolumes.get(id)
+	if mounted[vol.TargetPath] && !queued {
+		return
+	}
+	if mounted = mounts(); mounted == nil {
+		return
+	}
+
+	if !mounted[vol.TargetPath] {
+		correct(unmountedVolume, "volume %s of pod %s is no longer mounted at %s, queueing it for deletion",
+			vol.ID, vol.PodUUID, vol.TargetPath)
+		n.queueForDeletion(vol.ID, vol)
+	} else if queued {
+		correct(mountedCandidate, "volume %s of pod %s is still mounted at %s, removing it from the deletion queue",
+			vol.ID, vol.PodUUID, vol.TargetPath)
+		n.deletedVolumes.pruneLock.Lock()
+		n.deletedVolumes.remove(vol.ID)
+		n.deletedVolumes.pruneLock.Unlock()
+	}
+}
+
+// reconcilePool removes the empty pod directories of the pool and adopts the volumes found in it without a record.
+func (n *node) reconcilePool(pool *storagePool, correct func(kind, format string, args ...interface{})) {
+	pods, err := ioutil.ReadDir(pool.workdir)
+	if err != nil {
+		glog.Errorf("reconciliation: unable to read working directory %s: %s", pool.workdir, err)
+		return
+	}
+
+	for _, pod := range pods {
+		// Skip the persistent storage and health probes
+		if !pod.IsDir() || strings.HasPrefix(pod.Name(), ".") {
+			continue
+		}
+
+		podDir := filepath.Join(pool.workdir, pod.Name())
+		entries, err := ioutil.ReadDir(podDir)
+		if err != nil {
+			glog.Errorf("reconciliation: unable to read pod directory %s: %s", podDir, err)
+			continue
+		}
+
+		if len(entries) == 0 && time.Since(pod.ModTime()) > emptyPodDirectoryGracePeriod {
+			if err := os.Remove(podDir); err == nil {
+				correct(emptyPodDirectory, "removed empty pod directory %s", podDir)
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			n.adoptOrphan(pool, pod.Name(), entry, correct)
+		}
+	}
+}
+
+// adoptOrphan queues a volume found in the pool's working directory for deletion unless it is known to the node.
+// The volume's modification time is used as the time it was unpublished.
+func (n *node) adoptOrphan(pool *storagePool, podUUID string, entry os.FileInfo, correct func(kind, format string, args ...interface{})) {
+	id := strings.TrimPrefix(entry.Name(), stagingPrefix)
+	if !n.locks.tryAcquire(id) {
+		return
+	}
+	defer n.locks.release(id)
+
+	// Nothing was ever handed to a pod from a staging directory, so it can go right away
+	if id != entry.Name() {
+		path := filepath.Join(pool.workdir, podUUID, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			glog.Errorf("reconciliation: unable to remove staging directory %s: %s", path, err)
+			return
+		}
+		correct(stagingVolume, "removed staging directory %s", path)
+		return
+	}
+
+	if _, err := n.volumeByID(id); err == nil {
+		return
+	}
+	if _, queued := n.deletedVolumes.get(id); queued {
+		return
+	}
+
+	path := fullpath(pool.workdir, podUUID, id)
+	volAccessType := mountAccess
+	var projectID uint32
+	if entry.Mode().IsRegular() {
+		volAccessType = blockAccess
+	} else {
+		// The quota of the directory is released once the pruner deletes it
+		projectID = pool.quota.adopt(path)
+	}
+	correct(orphanVolume, "%s of pod %s has no record, queueing it for deletion as of %s",
+		path, podUUID, entry.ModTime().Format(time.RFC3339))
+	n.deletedVolumes.queue(id, deletionCandidate{
+		Time:       entry.ModTime(),
+		Lifespan:   pool.afterLifespan,
+		Path:       path,
+		PodUUID:    podUUID,
+		ProjectID:  projectID,
+		Pool:       pool.name,
+		AccessType: volAccessType,
+	})
+}
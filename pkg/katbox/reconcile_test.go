@@ -0,0 +1,188 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestReconcile(t *testing.T) {
+	n := newTestNode(t)
+
+	mkdir := func(pod, id string) string {
+		path := fullpath(n.workdir, pod, id)
+		require.NoError(t, os.MkdirAll(path, 0750))
+		return path
+	}
+
+	// A volume that is still mounted and one the kubelet unmounted while the plugin was down
+	for _, id := range []string{"mounted", "unmounted"} {
+		n.setVolume(volume{ID: id, PodUUID: "pod1", Path: mkdir("pod1", id), TargetPath: "/target/" + id, Ephemeral: true})
+		persistVolume(t, n, id)
+	}
+
+	// A candidate for a volume that is still mounted, from a crash halfway through unpublishing
+	mountedPath := fullpath(n.workdir, "pod1", "mounted")
+	n.deletedVolumes.queue("mounted", deletionCandidate{Time: time.Now(), Lifespan: time.Hour, Path: mountedPath})
+
+	// A candidate whose directory was removed by hand
+	n.deletedVolumes.queue("missing", deletionCandidate{Time: time.Now(), Lifespan: time.Hour, Path: fullpath(n.workdir, "pod2", "missing")})
+
+	// A directory nobody knows about
+	orphanPath := mkdir("pod3", "orphan")
+	orphanTime := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(orphanPath, orphanTime, orphanTime))
+
+	// An empty pod directory, along with one that could be getting published into
+	emptyPod := filepath.Join(n.workdir, "pod4")
+	require.NoError(t, os.Mkdir(emptyPod, 0750))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(emptyPod, old, old))
+	newPod := filepath.Join(n.workdir, "pod5")
+	require.NoError(t, os.Mkdir(newPod, 0750))
+
+	// A volume left half prepared by a crash
+	staging := stagingPath(fullpath(n.workdir, "pod3", "halfway"))
+	require.NoError(t, os.MkdirAll(staging, 0700))
+
+	// Files at the top of the working directory are left alone
+	require.NoError(t, ioutil.WriteFile(filepath.Join(n.workdir, ".probe-1"), nil, 0600))
+
+	before := testutil.ToFloat64(reconcileCorrections.WithLabelValues(orphanVolume))
+	n.reconcile(func() map[string]bool { return map[string]bool{"/target/mounted": true} })
+
+	_, err := n.volumeByID("mounted")
+	assert.NoError(t, err, "mounted volume should stay live")
+	_, queued := n.deletedVolumes.get("mounted")
+	assert.False(t, queued, "mounted volume should not be queued for deletion")
+
+	_, err = n.volumeByID("unmounted")
+	assert.Error(t, err, "unmounted volume should no longer be live")
+	candidate, queued := n.deletedVolumes.get("unmounted")
+	require.True(t, queued, "unmounted volume should be queued for deletion")
+	assert.Equal(t, fullpath(n.workdir, "pod1", "unmounted"), candidate.Path)
+	persisted, err := loadVolumesFromPersistent(n.storage, volumesBucketName)
+	require.NoError(t, err)
+	assert.NotContains(t, persisted, "unmounted")
+
+	_, queued = n.deletedVolumes.get("missing")
+	assert.False(t, queued, "missing candidate should be removed from the queue")
+
+	candidate, queued = n.deletedVolumes.get("orphan")
+	require.True(t, queued, "orphan should be queued for deletion")
+	assert.Equal(t, orphanPath, candidate.Path)
+	assert.Equal(t, "pod3", candidate.PodUUID)
+	assert.True(t, orphanTime.Equal(candidate.Time), candidate.Time)
+	assert.Equal(t, n.afterLifespan, candidate.Lifespan)
+	assert.Equal(t, before+1, testutil.ToFloat64(reconcileCorrections.WithLabelValues(orphanVolume)))
+
+	assert.NoDirExists(t, staging)
+	_, queued = n.deletedVolumes.get("halfway")
+	assert.False(t, queued, "staging directories should be removed rather than queued")
+
+	assert.NoDirExists(t, emptyPod)
+	assert.DirExists(t, newPod)
+	assert.FileExists(t, filepath.Join(n.workdir, ".probe-1"))
+
+	// Reconciling again finds nothing left to correct
+	sum := func() (s float64) {
+		for _, kind := range []string{unmountedVolume, mountedCandidate, missingCandidate, orphanVolume, emptyPodDirectory, stagingVolume} {
+			s += testutil.ToFloat64(reconcileCorrections.WithLabelValues(kind))
+		}
+		return s
+	}
+	corrections := sum()
+	n.reconcile(func() map[string]bool { return map[string]bool{"/target/mounted": true} })
+	assert.Equal(t, corrections, sum())
+}
+
+func TestReconcileWithoutMountInfo(t *testing.T) {
+	n := newTestNode(t)
+
+	path := fullpath(n.workdir, "pod1", "vol1")
+	require.NoError(t, os.MkdirAll(path, 0750))
+	n.setVolume(volume{ID: "vol1", PodUUID: "pod1", Path: path, TargetPath: "/target/vol1"})
+
+	// Live volumes are left alone when mounts can't be read
+	n.reconcile(nil)
+	_, err := n.volumeByID("vol1")
+	assert.NoError(t, err)
+	_, queued := n.deletedVolumes.get("vol1")
+	assert.False(t, queued)
+}
+
+func TestReconcilePublishedAfterSnapshot(t *testing.T) {
+	n := newTestNode(t)
+
+	path := fullpath(n.workdir, "pod1", "vol1")
+	require.NoError(t, os.MkdirAll(path, 0750))
+
+	// The volume is published after the first mount points were read but before the volumes are listed
+	reads := 0
+	mounts := func() map[string]bool {
+		reads++
+		if reads == 1 {
+			n.setVolume(volume{ID: "vol1", PodUUID: "pod1", Path: path, TargetPath: "/target/vol1"})
+			return map[string]bool{}
+		}
+		return map[string]bool{"/target/vol1": true}
+	}
+
+	n.reconcile(mounts)
+	_, err := n.volumeByID("vol1")
+	assert.NoError(t, err, "volume published after the snapshot should stay live")
+	_, queued := n.deletedVolumes.get("vol1")
+	assert.False(t, queued)
+	assert.Equal(t, 2, reads, "mount points should be read again before correcting the volume")
+}
+
+func TestMountPoints(t *testing.T) {
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	require.NoError(t, ioutil.WriteFile(mountInfo, []byte(
+		"25 30 0:23 / /sys rw,nosuid shared:7 - sysfs sysfs rw\n"+
+			"820 30 8:1 /csi-data-dir/pod1/vol1 /var/lib/kubelet/pods/pod1/volumes/kubernetes.io~csi/data/mount rw shared:1 - ext4 /dev/sda1 rw\n",
+	), 0600))
+
+	assert.Equal(t, map[string]bool{
+		"/sys": true,
+		"/var/lib/kubelet/pods/pod1/volumes/kubernetes.io~csi/data/mount": true,
+	}, mountPoints(mountInfo))
+
+	assert.Nil(t, mountPoints(filepath.Join(t.TempDir(), "missing")))
+}
+
+func persistVolume(t *testing.T, n *node, id string) {
+	vol, err := n.volumeByID(id)
+	require.NoError(t, err)
+	require.NoError(t, n.storage.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(vol)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(volumesBucketName)).Put([]byte(id), data)
+	}))
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/mount-utils"
+)
+
+var (
+	errAmbiguousRetained = errors.New("pod retains several volumes, one has to be picked by its volume ID")
+	errNotADirectory     = errors.New("only directory volumes can be attached")
+	errBeingDeleted      = errors.New("volume is being deleted")
+)
+
+// resolveRetained returns the ID of the candidate referred to by a volume ID, or by the UUID of the pod
+// that owned it as long as the pod retains a single volume.
+func (d *deletedVolumes) resolveRetained(ref string) (string, error) {
+	if _, found := d.get(ref); found {
+		return ref, nil
+	}
+
+	switch ids := d.idsForPod(ref); len(ids) {
+	case 0:
+		return "", fmt.Errorf("%s: %w", ref, errCandidateNotFound)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%s: %w", ref, errAmbiguousRetained)
+	}
+}
+
+// attachRetained hands the retained directory referred to by ref over to the volume viewerID, which shows it read
+// only. The pruner leaves the candidate alone while it is attached, and the time it spends attached is added
+// to its afterlife once the last viewer detaches.
+func (n *node) attachRetained(ref, viewerID string) (string, *deletionCandidate, error) {
+	d := &n.deletedVolumes
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	id, err := d.resolveRetained(ref)
+	if err != nil {
+		return "", nil, err
+	}
+
+	d.lock.RLock()
+	vol, found := d.candidates[id]
+	_, deleting := d.inFlight[id]
+	d.lock.RUnlock()
+
+	if !found || vol == nil {
+		return "", nil, fmt.Errorf("%s: %w", id, errCandidateNotFound)
+	}
+	if vol.AccessType != mountAccess {
+		return "", nil, fmt.Errorf("%s is a %s volume: %w", id, vol.AccessType, errNotADirectory)
+	}
+	// A deletion which outlived its timeout may have already removed part of the directory
+	if deleting {
+		return "", nil, fmt.Errorf("%s: %w", id, errBeingDeleted)
+	}
+	if info, err := os.Stat(vol.Path); err != nil || !info.IsDir() {
+		return "", nil, fmt.Errorf("%s at %s: %w", id, vol.Path, errCandidateNotFound)
+	}
+
+	updated := *vol
+	for _, viewer := range vol.Viewers {
+		if viewer == viewerID {
+			return id, vol, nil
+		}
+	}
+	updated.Viewers = append(append([]string{}, vol.Viewers...), viewerID)
+	if len(vol.Viewers) == 0 {
+		updated.AttachedAt = time.Now()
+	}
+
+	if err := d.replace(id, updated); err != nil {
+		return "", nil, fmt.Errorf("unable to persist attachment of %s: %w", id, err)
+	}
+	glog.Infof("attached %s at %s read only to %s", id, vol.Path, viewerID)
+	return id, &updated, nil
+}
+
+// detachRetained hands the candidate back to the pruner once viewerID was its last viewer.
+func (n *node) detachRetained(id, viewerID string) error {
+	d := &n.deletedVolumes
+	d.pruneLock.Lock()
+	defer d.pruneLock.Unlock()
+
+	vol, found := d.get(id)
+	if !found {
+		return nil
+	}
+
+	updated := *vol
+	updated.Viewers = nil
+	for _, viewer := range vol.Viewers {
+		if viewer != viewerID {
+			updated.Viewers = append(updated.Viewers, viewer)
+		}
+	}
+	if len(updated.Viewers) == len(vol.Viewers) {
+		return nil
+	}
+
+	// The afterlife is put on hold while the volume is looked at
+	if len(updated.Viewers) == 0 {
+		updated.Time = updated.Time.Add(time.Since(vol.AttachedAt))
+		updated.AttachedAt = time.Time{}
+	}
+
+	if err := d.replace(id, updated); err != nil {
+		return fmt.Errorf("unable to persist detachment of %s: %w", id, err)
+	}
+	glog.Infof("detached %s at %s from %s", id, vol.Path, viewerID)
+	return nil
+}
+
+// replace persists the candidate and swaps it for the one in memory, unless it was removed in the meantime.
+func (d *deletedVolumes) replace(id string, vol deletionCandidate) error {
+	if err := d.persist(id, vol); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	if _, found := d.candidates[id]; found {
+		d.candidates[id] = &vol
+	}
+	d.lock.Unlock()
+	return nil
+}
+
+// update applies the change to the current copy of the candidate and persists it, so that changes made to the
+// candidate since the caller last read it aren't lost.
+func (d *deletedVolumes) update(id string, change func(vol *deletionCandidate)) (*deletionCandidate, error) {
+	vol, found := d.get(id)
+	if !found {
+		return nil, fmt.Errorf("%s: %w", id, errCandidateNotFound)
+	}
+
+	updated := *vol
+	change(&updated)
+	if err := d.replace(id, updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// publishRetained bind mounts the retained directory named by the attachRetained attribute read only at the
+// target path, whatever the pod asked for. The volume owns nothing on disk and only hands the directory back
+// to the pruner when unpublished.
+func (ns *nodeServer) publishRetained(req *csi.NodePublishVolumeRequest, pod podRef, ref string) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeCapability().GetMount() == nil || req.GetVolumeCapability().GetMount().GetFsType() != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s volumes must be directory volumes", attachRetainedContext)
+	}
+	for _, attribute := range []string{sizeContext, inodesContext, retentionContext, poolContext, templateContext, uidContext, gidContext, modeContext} {
+		if _, ok := req.GetVolumeContext()[attribute]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "%s attribute cannot be combined with %s", attribute, attachRetainedContext)
+		}
+	}
+
+	volID, targetPath := req.GetVolumeId(), req.GetTargetPath()
+	id, candidate, err := ns.node.attachRetained(ref, volID)
+	switch {
+	case errors.Is(err, errCandidateNotFound):
+		return nil, status.Errorf(codes.NotFound, "no retained volume %s, it may have been pruned: %v", ref, err)
+	case errors.Is(err, errAmbiguousRetained), errors.Is(err, errNotADirectory):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errBeingDeleted):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	notMnt, err := mount.IsNotMountPoint(ns.mounter, targetPath)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(targetPath, 0750)
+		notMnt = true
+	}
+	if err == nil && notMnt {
+		err = ns.mounter.Mount(candidate.Path, targetPath, "", []string{"bind", "ro"})
+	}
+	if err != nil {
+		if err2 := ns.node.detachRetained(id, volID); err2 != nil {
+			glog.Errorf("unable to detach %s: %s", id, err2)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to mount %s at %s: %v", candidate.Path, targetPath, err)
+	}
+
+	vol := volume{
+		Name:         fmt.Sprintf("ephemeral-%s", volID),
+		ID:           volID,
+		PodUUID:      pod.UID,
+		Path:         candidate.Path,
+		Pool:         candidate.Pool,
+		Size:         maxStorageCapacity,
+		Ephemeral:    true,
+		Retained:     id,
+		TargetPath:   targetPath,
+		PodName:      pod.Name,
+		PodNamespace: pod.Namespace,
+	}
+	ns.node.setVolume(vol)
+	if err := ns.node.saveVolume(vol); err != nil {
+		glog.Errorf("Unable to persist volume %s: %s", volID, err)
+	}
+
+	ns.node.events.podEvent(pod, v1.EventTypeNormal, volumePublished,
+		"Published retained volume %s of pod %s read only as volume %s", id, candidate.pod(), volID)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
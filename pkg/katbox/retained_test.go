@@ -0,0 +1,208 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retainVolume publishes a volume for the pod, writes a file into it and unpublishes it.
+func retainVolume(t *testing.T, ns *nodeServer, volID, podUUID string) *deletionCandidate {
+	targetDir := t.TempDir()
+	_, err := ns.NodePublishVolume(context.Background(), publishRequest(targetDir, volID, podUUID))
+	require.NoError(t, err)
+
+	vol, err := ns.node.volumeByID(volID)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(vol.Path, "core"), []byte("crash"), 0600))
+
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   volID,
+		TargetPath: filepath.Join(targetDir, volID),
+	})
+	require.NoError(t, err)
+
+	candidate, queued := ns.node.deletedVolumes.get(volID)
+	require.True(t, queued)
+	return candidate
+}
+
+func attachRequest(targetDir, volID, podUUID, ref string) *csi.NodePublishVolumeRequest {
+	req := publishRequest(targetDir, volID, podUUID)
+	req.VolumeContext[attachRetainedContext] = ref
+	return req
+}
+
+func TestAttachRetained(t *testing.T) {
+	ns, mounter := newTestNodeServer(t)
+	n := ns.node
+	retained := retainVolume(t, ns, "vol1", "pod1")
+
+	// Make the candidate due for deletion
+	expired := *retained
+	expired.Time = time.Now().Add(-2 * expired.Lifespan)
+	require.NoError(t, n.deletedVolumes.replace("vol1", expired))
+
+	// The pod UUID is enough when the pod retains a single volume
+	targetDir := t.TempDir()
+	targetPath := filepath.Join(targetDir, "viewer")
+	_, err := ns.NodePublishVolume(context.Background(), attachRequest(targetDir, "viewer", "pod2", "pod1"))
+	require.NoError(t, err)
+
+	mountPoints, err := mounter.List()
+	require.NoError(t, err)
+	require.Len(t, mountPoints, 1)
+	assert.Equal(t, retained.Path, mountPoints[0].Device)
+	assert.Equal(t, targetPath, mountPoints[0].Path)
+	assert.Contains(t, mountPoints[0].Opts, "ro", "retained volumes should be mounted read only")
+
+	viewer, err := n.volumeByID("viewer")
+	require.NoError(t, err)
+	assert.Equal(t, "vol1", viewer.Retained)
+
+	// Stats come from the retained directory, which isn't held to any limit
+	stats, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "viewer", VolumePath: targetPath})
+	require.NoError(t, err)
+	assert.False(t, stats.GetVolumeCondition().GetAbnormal(), stats.GetVolumeCondition().GetMessage())
+	require.Len(t, stats.GetUsage(), 2)
+	assert.GreaterOrEqual(t, stats.GetUsage()[0].GetUsed(), int64(len("crash")))
+	n.checkSoftLimits()
+	viewer, err = n.volumeByID("viewer")
+	require.NoError(t, err)
+	assert.False(t, viewer.OverLimit, "viewers should not be measured against a limit")
+	candidate, queued := n.deletedVolumes.get("vol1")
+	require.True(t, queued)
+	assert.Equal(t, []string{"viewer"}, candidate.Viewers)
+
+	// Publishing again is a no-op
+	_, err = ns.NodePublishVolume(context.Background(), attachRequest(targetDir, "viewer", "pod2", "vol1"))
+	require.NoError(t, err)
+	candidate, _ = n.deletedVolumes.get("vol1")
+	assert.Equal(t, []string{"viewer"}, candidate.Viewers)
+
+	// The pruner and forced deletions leave the attached volume alone
+	deleted, _ := n.deletedVolumes.prune(n.workdir, 0)
+	assert.Empty(t, deleted)
+	_, err = n.deletedVolumes.forceDelete("vol1")
+	assert.True(t, errors.Is(err, errCandidateMounted), err)
+	assert.FileExists(t, filepath.Join(retained.Path, "core"))
+
+	_, err = ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      "viewer",
+		VolumePath:    targetPath,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: mib},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Unpublishing hands the volume back to the pruner with the time it was attached added to its afterlife
+	_, err = ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "viewer", TargetPath: targetPath})
+	require.NoError(t, err)
+
+	_, err = n.volumeByID("viewer")
+	assert.Error(t, err)
+	_, queued = n.deletedVolumes.get("viewer")
+	assert.False(t, queued, "viewers should never be queued for deletion")
+	candidate, queued = n.deletedVolumes.get("vol1")
+	require.True(t, queued)
+	assert.Empty(t, candidate.Viewers)
+	assert.True(t, candidate.AttachedAt.IsZero())
+	assert.True(t, candidate.Time.After(expired.Time), "afterlife should be extended by the time spent attached")
+	persisted, err := loadVolumesFromPersistent(n.storage, deletedVolumesBucketName)
+	require.NoError(t, err)
+	assert.NotContains(t, persisted, "viewer")
+
+	deleted, _ = n.deletedVolumes.prune(n.workdir, 0)
+	assert.Equal(t, []string{"vol1"}, deleted)
+
+	// Pruned volumes can't be attached anymore
+	_, err = ns.NodePublishVolume(context.Background(), attachRequest(t.TempDir(), "late", "pod3", "vol1"))
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAttachRetainedValidation(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	n := ns.node
+	withFakeLoopDevices(n)
+
+	retainVolume(t, ns, "vol1", "pod1")
+	retainVolume(t, ns, "vol2", "pod1")
+	retainVolume(t, ns, "vol3", "pod2")
+	n.deletedVolumes.queue("block", deletionCandidate{
+		Time:       time.Now(),
+		Lifespan:   time.Hour,
+		Path:       filepath.Join(n.workdir, "pod3", "block"),
+		PodUUID:    "pod3",
+		AccessType: blockAccess,
+	})
+
+	// A deletion which outlived its timeout
+	n.deletedVolumes.inFlight = map[string]chan deletionResult{"vol3": make(chan deletionResult, 1)}
+
+	tests := []struct {
+		name string
+		ref  string
+		mod  func(req *csi.NodePublishVolumeRequest)
+		code codes.Code
+	}{
+		{name: "unknown", ref: "missing", code: codes.NotFound},
+		{name: "ambiguous pod", ref: "pod1", code: codes.InvalidArgument},
+		{name: "block", ref: "block", code: codes.InvalidArgument},
+		{name: "being deleted", ref: "vol3", code: codes.FailedPrecondition},
+		{
+			name: "sized",
+			ref:  "vol1",
+			mod:  func(req *csi.NodePublishVolumeRequest) { req.VolumeContext[sizeContext] = "1Gi" },
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "image",
+			ref:  "vol1",
+			mod:  func(req *csi.NodePublishVolumeRequest) { req.VolumeCapability.GetMount().FsType = "ext4" },
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := attachRequest(t.TempDir(), "viewer", "pod4", tt.ref)
+			if tt.mod != nil {
+				tt.mod(req)
+			}
+
+			_, err := ns.NodePublishVolume(context.Background(), req)
+			assert.Equal(t, tt.code, status.Code(err), err)
+			_, err = n.volumeByID("viewer")
+			assert.Error(t, err, "no volume should be created")
+		})
+	}
+
+	for _, id := range []string{"vol1", "vol2", "vol3"} {
+		candidate, _ := n.deletedVolumes.get(id)
+		assert.Empty(t, candidate.Viewers, id)
+	}
+}
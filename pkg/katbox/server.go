@@ -83,7 +83,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, n
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(logGRPC, metricsGRPC),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
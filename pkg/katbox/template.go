@@ -0,0 +1,95 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	utilexec "k8s.io/utils/exec"
+)
+
+// Kinds of templates new volumes may be seeded from
+const (
+	templateDirectory = "directory"
+	templateTar       = "tar"
+	templateTarGz     = "tar.gz"
+)
+
+// findTemplate returns the path and kind of the template registered on the node under the name.
+// A template is either a directory named after it or a tar archive, optionally gzipped, in the templates directory.
+func (n *node) findTemplate(name string) (string, string, error) {
+	if n.templatesDir == "" {
+		return "", "", fmt.Errorf("no templates are registered on node %s", n.id)
+	}
+
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", "", fmt.Errorf("invalid %s attribute %q: must be the name of a template", templateContext, name)
+	}
+
+	path := filepath.Join(n.templatesDir, name)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path, templateDirectory, nil
+	}
+
+	for suffix, kind := range map[string]string{".tar": templateTar, ".tar.gz": templateTarGz, ".tgz": templateTarGz} {
+		if info, err := os.Stat(path + suffix); err == nil && info.Mode().IsRegular() {
+			return path + suffix, kind, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("template %s is not registered on node %s", name, n.id)
+}
+
+// seedVolume fills the directory of a new volume with the template registered under the name.
+func (n *node) seedVolume(dir, name string) error {
+	path, kind, err := n.findTemplate(name)
+	if err != nil {
+		return err
+	}
+	return seedFromTemplate(dir, name, path, kind)
+}
+
+// seedFromTemplate fills the volume directory with the content of the template, preserving ownership and
+// permissions. Directories are reflinked when the filesystem supports it and copied otherwise.
+func seedFromTemplate(dir, name, path, kind string) error {
+	var args []string
+	switch kind {
+	case templateDirectory:
+		args = []string{"cp", "-a", "--reflink=auto", path + "/.", dir}
+	case templateTar:
+		args = []string{"tar", "-x", "-p", "--same-owner", "-f", path, "-C", dir}
+	case templateTarGz:
+		args = []string{"tar", "-x", "-z", "-p", "--same-owner", "-f", path, "-C", dir}
+	default:
+		return fmt.Errorf("unknown kind of template %s", kind)
+	}
+
+	start := time.Now()
+	out, err := utilexec.New().Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to copy template %s: %v, %v", name, err, string(out))
+	}
+
+	templateCopyDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	glog.V(4).Infof("seeded %s from template %s in %s", dir, name, time.Since(start))
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withTemplates registers a directory template named "tools" and a gzipped archive template named "dataset".
+func withTemplates(t *testing.T, n *node) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+
+	n.templatesDir = t.TempDir()
+
+	tools := filepath.Join(n.templatesDir, "tools")
+	require.NoError(t, os.MkdirAll(filepath.Join(tools, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tools, "bin", "run"), []byte("#!/bin/sh\n"), 0750))
+
+	f, err := os.Create(filepath.Join(n.templatesDir, "dataset.tar.gz"))
+	require.NoError(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	content := []byte("a,b\n1,2\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "data/rows.csv", Mode: 0640, Size: int64(len(content))}))
+	_, err = tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+}
+
+// templateCopies returns how many copies of the template were timed.
+func templateCopies(t *testing.T, template string) uint64 {
+	var m dto.Metric
+	require.NoError(t, templateCopyDuration.WithLabelValues(template).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPublishFromTemplate(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	withTemplates(t, ns.node)
+
+	tests := []struct {
+		template string
+		file     string
+		content  string
+		mode     os.FileMode
+	}{
+		{template: "tools", file: "bin/run", content: "#!/bin/sh\n", mode: 0750},
+		{template: "dataset", file: "data/rows.csv", content: "a,b\n1,2\n", mode: 0640},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			copies := templateCopies(t, tt.template)
+
+			req := publishRequest(t.TempDir(), "vol-"+tt.template, "pod1")
+			req.VolumeContext[templateContext] = tt.template
+			_, err := ns.NodePublishVolume(context.Background(), req)
+			require.NoError(t, err)
+
+			vol, err := ns.node.volumeByID("vol-" + tt.template)
+			require.NoError(t, err)
+			assert.Equal(t, tt.template, vol.Template)
+
+			info, err := os.Stat(filepath.Join(vol.Path, tt.file))
+			require.NoError(t, err)
+			assert.Equal(t, tt.mode, info.Mode().Perm())
+			content, err := ioutil.ReadFile(filepath.Join(vol.Path, tt.file))
+			require.NoError(t, err)
+			assert.Equal(t, tt.content, string(content))
+
+			assert.Equal(t, copies+1, templateCopies(t, tt.template), "copy time should be recorded per template")
+		})
+	}
+}
+
+func TestTemplateValidation(t *testing.T) {
+	ns, _ := newTestNodeServer(t)
+	withTemplates(t, ns.node)
+
+	tests := []struct {
+		name     string
+		template string
+		block    bool
+	}{
+		{name: "unknown", template: "missing"},
+		{name: "empty", template: ""},
+		{name: "hidden", template: ".tools"},
+		{name: "escaping", template: "../tools"},
+		{name: "block", template: "tools", block: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := publishRequest(t.TempDir(), "vol-"+tt.name, "pod1")
+			if tt.block {
+				req = blockPublishRequest(t.TempDir(), "vol-"+tt.name, "pod1")
+			}
+			req.VolumeContext[templateContext] = tt.template
+
+			_, err := ns.NodePublishVolume(context.Background(), req)
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			_, err = ns.node.volumeByID("vol-" + tt.name)
+			assert.Error(t, err, "no volume should be created")
+		})
+	}
+
+	ns.node.templatesDir = ""
+	req := publishRequest(t.TempDir(), "vol-disabled", "pod1")
+	req.VolumeContext[templateContext] = "tools"
+	_, err := ns.NodePublishVolume(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "templates should be rejected when none are configured")
+}
@@ -33,14 +33,48 @@ type accessType int
 const (
 	mountAccess accessType = iota
 	blockAccess
+	// imageAccess volumes are mounted like mountAccess ones but hold a filesystem of their own inside an image file
+	imageAccess
 )
 
+func (a accessType) String() string {
+	switch a {
+	case blockAccess:
+		return "block"
+	case imageAccess:
+		return "image"
+	default:
+		return "mount"
+	}
+}
+
+// usesLoopDevice reports whether volumes of the access type are files attached to a loop device.
+func (a accessType) usesLoopDevice() bool {
+	return a == blockAccess || a == imageAccess
+}
+
 // Available contexts for volume
 const (
 	podUUIDContext = "csi.storage.k8s.io/pod.uid"
+	podNameContext = "csi.storage.k8s.io/pod.name"
+	podNamespaceContext = "csi.storage.k8s.io/pod.namespace"
 	ephemeralContext = "csi.storage.k8s.io/ephemeral"
 )
 
+// Volume attributes that may be set by the pod author
+const (
+	sizeContext      = "size"
+	inodesContext    = "inodes"
+	retentionContext = "retention"
+	poolContext      = "pool"
+	templateContext  = "template"
+	uidContext       = "uid"
+	gidContext       = "gid"
+	modeContext      = "mode"
+
+	attachRetainedContext = "attachRetained"
+)
+
 const (
 	volumesBucketName = "volumes"
 	deletedVolumesBucketName = "deletedVolumes"
@@ -17,11 +17,17 @@ package katbox
 
 import (
 	"errors"
+	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
+
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 // fullpath returns the location where the katbox volume will be created inside the container
@@ -30,6 +36,14 @@ func fullpath(workdir, podUUID, p string) string {
 	return filepath.Join(workdir, podUUID, p)
 }
 
+// stagingPrefix is prepended to the name of volume directories while they are being prepared.
+const stagingPrefix = ".staging-"
+
+// stagingPath returns where the volume at path is prepared before being moved in place.
+func stagingPath(path string) string {
+	return filepath.Join(filepath.Dir(path), stagingPrefix+filepath.Base(path))
+}
+
 // pressureFactor returns a value to be used with afterlife calculations.
 // The more space we're using in the head room, the more aggressive the early eviction should be.
 // Therefore, as the the ratio of headroom space available diminishes, our ratio gets lower and lower.
@@ -59,6 +73,83 @@ func pressureFactor(total, free uint64, headroom float64) (float64, error) {
 	return 1.0 - float64(headroomSpace-free)/float64(headroomSpace), nil
 }
 
+// describeLimits returns a description of the size and inode limits of the volume, if it has any.
+func describeLimits(vol *volume) string {
+	var limits []string
+	if vol.Size < maxStorageCapacity {
+		limits = append(limits, resource.NewQuantity(vol.Size, resource.BinarySI).String())
+	}
+	if vol.Inodes > 0 {
+		limits = append(limits, fmt.Sprintf("%d inodes", vol.Inodes))
+	}
+
+	if len(limits) == 0 {
+		return ""
+	}
+	return " limited to " + strings.Join(limits, " and ")
+}
+
+// volumeLimits parses the size and inode limits requested through the volume attributes.
+// A volume without a size attribute may grow up to maxStorageCapacity while a zero inode count means no limit.
+func volumeLimits(attributes map[string]string) (int64, int64, error) {
+	size := maxStorageCapacity
+	if value, ok := attributes[sizeContext]; ok {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s attribute %q: %w", sizeContext, value, err)
+		}
+
+		size = quantity.Value()
+		if size <= 0 || size > maxStorageCapacity {
+			return 0, 0, fmt.Errorf("%s attribute must be between 1 and %d bytes", sizeContext, maxStorageCapacity)
+		}
+	}
+
+	var inodes int64
+	if value, ok := attributes[inodesContext]; ok {
+		var err error
+		inodes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || inodes <= 0 {
+			return 0, 0, fmt.Errorf("invalid %s attribute %q: must be a positive integer", inodesContext, value)
+		}
+	}
+
+	return size, inodes, nil
+}
+
+// volumeRetention parses the afterlife requested through the volume attributes and clamps it between
+// min and max. A zero max leaves the afterlife unbounded. Nil is returned when no retention was requested.
+func volumeRetention(attributes map[string]string, min, max time.Duration) (*time.Duration, error) {
+	value, ok := attributes[retentionContext]
+	if !ok {
+		return nil, nil
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention < 0 {
+		return nil, fmt.Errorf("invalid %s attribute %q: must be a non negative duration", retentionContext, value)
+	}
+
+	retention = clampDuration(retention, min, max)
+	return &retention, nil
+}
+
+// clampDuration limits d to the range between min and max. A zero max leaves d unbounded from above.
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if d < min {
+		return min
+	}
+	if max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
+// roundUpToMiB rounds the size up to a whole number of mebibytes, the granularity of loop backed volumes.
+func roundUpToMiB(size int64) int64 {
+	return (size + mib - 1) / mib * mib
+}
+
 // makeFile ensures that the file exists, creating it if necessary.
 // The parent directory must exist.
 func makeFile(pathname string) error {
@@ -17,6 +17,7 @@ package katbox
 
 import (
     "testing"
+    "time"
 
     "github.com/stretchr/testify/assert"
 )
@@ -48,4 +49,71 @@ func Test_pressureFactor(t *testing.T) {
             }
         })
     }
-}
\ No newline at end of file
+}
+
+func Test_volumeLimits(t *testing.T) {
+    tests := []struct {
+        name           string
+        attributes     map[string]string
+        expectedSize   int64
+        expectedInodes int64
+        expectErr      bool
+    }{
+        {"noAttributes", map[string]string{}, maxStorageCapacity, 0, false},
+        {"size", map[string]string{sizeContext: "2Gi"}, 2 * gib, 0, false},
+        {"sizeAndInodes", map[string]string{sizeContext: "512Mi", inodesContext: "1000"}, 512 * mib, 1000, false},
+        {"invalidSize", map[string]string{sizeContext: "lots"}, 0, 0, true},
+        {"zeroSize", map[string]string{sizeContext: "0"}, 0, 0, true},
+        {"tooLarge", map[string]string{sizeContext: "2Ti"}, 0, 0, true},
+        {"negativeInodes", map[string]string{inodesContext: "-1"}, 0, 0, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            size, inodes, err := volumeLimits(tt.attributes)
+
+            if tt.expectErr {
+                assert.Error(t, err, "expected an error")
+            } else {
+                assert.NoError(t, err, "unexpected error")
+                assert.Equal(t, tt.expectedSize, size, "Incorrect size")
+                assert.Equal(t, tt.expectedInodes, inodes, "Incorrect inode count")
+            }
+        })
+    }
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+    return &d
+}
+
+func Test_volumeRetention(t *testing.T) {
+    tests := []struct {
+        name       string
+        attributes map[string]string
+        min        time.Duration
+        max        time.Duration
+        expected   *time.Duration
+        expectErr  bool
+    }{
+        {"noAttribute", map[string]string{}, time.Minute, time.Hour, nil, false},
+        {"explicitZero", map[string]string{retentionContext: "0s"}, 0, time.Hour, durationPtr(0), false},
+        {"withinBounds", map[string]string{retentionContext: "30m"}, time.Minute, time.Hour, durationPtr(30 * time.Minute), false},
+        {"belowMin", map[string]string{retentionContext: "10s"}, time.Minute, time.Hour, durationPtr(time.Minute), false},
+        {"aboveMax", map[string]string{retentionContext: "72h"}, time.Minute, time.Hour, durationPtr(time.Hour), false},
+        {"unbounded", map[string]string{retentionContext: "72h"}, 0, 0, durationPtr(72 * time.Hour), false},
+        {"invalid", map[string]string{retentionContext: "3 days"}, 0, 0, nil, true},
+        {"negative", map[string]string{retentionContext: "-1h"}, 0, 0, nil, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            retention, err := volumeRetention(tt.attributes, tt.min, tt.max)
+
+            if tt.expectErr {
+                assert.Error(t, err, "expected an error")
+            } else {
+                assert.NoError(t, err, "unexpected error")
+                assert.Equal(t, tt.expected, retention, "Incorrect retention")
+            }
+        })
+    }
+}
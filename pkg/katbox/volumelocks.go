@@ -0,0 +1,51 @@
+/*
+Copyright 2020 PayPal.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package katbox
+
+import (
+	"sync"
+)
+
+// volumeLocks keeps track of the volume IDs with a CSI operation in progress so that operations
+// on the same volume never overlap. The zero value is ready to use.
+type volumeLocks struct {
+	lock       sync.Mutex
+	inProgress map[string]struct{}
+}
+
+// tryAcquire marks an operation on the volume as in progress. It returns false if one already is.
+func (l *volumeLocks) tryAcquire(id string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.inProgress == nil {
+		l.inProgress = make(map[string]struct{})
+	}
+
+	if _, found := l.inProgress[id]; found {
+		return false
+	}
+	l.inProgress[id] = struct{}{}
+	return true
+}
+
+func (l *volumeLocks) release(id string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.inProgress, id)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -13,11 +14,16 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	_ "github.com/paypal/katbox/stream/docs"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
+// When set, serving a file inside a katbox volume refreshes the volume's access time so that
+// the lru eviction policy of the katbox plugin knows the volume is still being looked at.
+var workdir = flag.String("workdir", "", "katbox working directory holding <pod UUID>/<volume ID> directories")
+
 type StreamData struct {
 	Data   string `json:"data"`
 	Offset int64  `json:"offset"`
@@ -34,7 +40,7 @@ type FileInformation struct {
 }
 
 type Result struct {
-	Data []FileInformation `json:"data`
+	Data []FileInformation `json:"data"`
 }
 
 type Error struct {
@@ -68,6 +74,8 @@ func downloadhandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAccess(path[0])
+
 	file, err := os.Open(path[0])
 	if err != nil {
 		log.Print(err)
@@ -148,6 +156,7 @@ func readHandler(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 	}
 
+	recordAccess(path[0])
 	size := getSize(path[0])
 
 	// if offset is invalid set it to size of the file
@@ -253,6 +262,8 @@ func browseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAccess(path[0])
+
 	// walk through the directory structure and build fileInformation struct and append to result array
 	result := []FileInformation{}
 	//test := strings.Split(path[0], "/")[len(strings.Split(path[0], "/"))-1]
@@ -316,6 +327,39 @@ func browseHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// recordAccess refreshes the access time of the katbox volume holding p, leaving its modification time intact.
+// Volumes are laid out as <workdir>/<pod UUID>/<volume ID>.
+func recordAccess(p string) {
+	if *workdir == "" {
+		return
+	}
+
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return
+	}
+
+	rel, err := filepath.Rel(*workdir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) < 2 {
+		return
+	}
+
+	volumeDir := filepath.Join(*workdir, parts[0], parts[1])
+	info, err := os.Stat(volumeDir)
+	if err != nil {
+		return
+	}
+
+	if err := os.Chtimes(volumeDir, time.Now(), info.ModTime()); err != nil {
+		log.Print(err)
+	}
+}
+
 //Get the size of a file
 func getSize(p string) int64 {
 	if stat, err := os.Stat(p); err == nil {
@@ -331,6 +375,8 @@ func getSize(p string) int64 {
 // @host localhost:8080
 // @BasePath /
 func main() {
+	flag.Parse()
+
 	http.HandleFunc("/files/read", readHandler)
 	http.HandleFunc("/files/browse", browseHandler)
 	http.HandleFunc("/files/download", downloadhandler)
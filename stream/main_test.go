@@ -1,9 +1,14 @@
 package main
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestBrowseHandler(t *testing.T) {
@@ -125,3 +130,35 @@ func TestDownloadHandlerWithInvalidPath(t *testing.T) {
 			status, http.StatusOK)
 	}
 }
+
+func TestRecordAccess(t *testing.T) {
+	dir := t.TempDir()
+	volumeDir := filepath.Join(dir, "pod", "volume")
+	if err := os.MkdirAll(volumeDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(volumeDir, "log"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(volumeDir, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	*workdir = dir
+	defer func() { *workdir = "" }()
+	recordAccess(filepath.Join(volumeDir, "log"))
+
+	info, err := os.Stat(volumeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atime := info.Sys().(*syscall.Stat_t).Atim
+	if !time.Unix(atime.Sec, atime.Nsec).After(past) {
+		t.Errorf("access time was not refreshed")
+	}
+	if !info.ModTime().Equal(past) {
+		t.Errorf("modification time changed: got %v want %v", info.ModTime(), past)
+	}
+}